@@ -0,0 +1,318 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/garble/hashing"
+)
+
+// Assembly refers to the Go declarations of its package by name, as in
+// TEXT ·add(SB) or MOVQ ·counter(SB), AX, and to its consts and struct
+// offsets through the go_asm.h header, which the compiler writes from the
+// garbled source. The asm tool gets copies of the .s files with those names
+// hashed the same way transformGo hashes the declarations, which it finds by
+// parsing the package's Go files on their own.
+
+// asmNames holds the names in a package's Go files which assembly can refer
+// to, and whether each one is hashed.
+type asmNames struct {
+	// decls holds the funcs, vars and consts declared at the top level.
+	decls map[string]bool
+
+	// structs holds the struct types declared at the top level, along with
+	// their fields, for the offsets in go_asm.h.
+	structs map[string]map[string]bool
+}
+
+// transformAsm hashes the names in assembly files which come from the Go
+// side of a garbled package.
+func transformAsm(args []string) ([]string, error) {
+	flags, paths := splitFlagsFromFiles(args, ".s")
+	if len(paths) == 0 {
+		return args, nil
+	}
+	pkgPath := compiledPackagePath(flags)
+	if flagValue(flags, "-std") == "true" || !shouldGarble(flags) {
+		return args, nil
+	}
+	dir := filepath.Dir(paths[0])
+	names, err := readAsmNames(dir, flagValue(flags, "-p"))
+	if err != nil {
+		return nil, err
+	}
+	if names == nil {
+		return args, nil // //garble:ignore on the package
+	}
+
+	outDir, err := getGarbledCodeOutputDir()
+	if err != nil {
+		return nil, err
+	}
+	// Like in transformCompile, don't leak the temporary dir. Includes of
+	// files next to the assembly must still work from the copy.
+	flags = flagSetValue(flags, "-trimpath", outDir+"=>;"+flagValue(flags, "-trimpath"))
+	flags = append(flags, "-I", dir)
+	args = flags
+
+	quotedPath := strings.Replace(pkgPath, "/", "∕", -1)
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		newSrc := names.rewrite(string(src), quotedPath)
+		// Several packages may have a file with the same name, and the
+		// output dir may be shared.
+		tempFile := filepath.Join(outDir, hashing.HashWith(getSalt(), pkgPath+"/"+filepath.Base(path))+".s")
+		if err := ioutil.WriteFile(tempFile, []byte(newSrc), 0666); err != nil {
+			return nil, err
+		}
+		args = append(args, tempFile)
+	}
+	return args, nil
+}
+
+// asmSymbol matches a symbol such as ·name or foo∕bar·name, and asmMacro an
+// identifier which might come from go_asm.h, such as const_name.
+var (
+	asmSymbol = regexp.MustCompile(`([\p{L}\p{N}_.∕]*)·([\p{L}_][\p{L}\p{N}_]*)`)
+	asmMacro  = regexp.MustCompile(`\b[A-Za-z_][A-Za-z0-9_]*\b`)
+)
+
+// rewrite hashes the names of the package in an assembly file. Symbols of
+// other packages are left alone.
+func (n *asmNames) rewrite(src, quotedPath string) string {
+	src = asmSymbol.ReplaceAllStringFunc(src, func(match string) string {
+		m := asmSymbol.FindStringSubmatch(match)
+		qualifier, name := m[1], m[2]
+		if qualifier != "" && qualifier != quotedPath || !n.decls[name] {
+			return match
+		}
+		return qualifier + "·" + hashing.HashWith(getSalt(), name)
+	})
+	return asmMacro.ReplaceAllStringFunc(src, n.rewriteMacro)
+}
+
+// rewriteMacro hashes the names in a go_asm.h macro, which are const_name,
+// Type__size, and Type_field.
+func (n *asmNames) rewriteMacro(ident string) string {
+	if name := strings.TrimPrefix(ident, "const_"); name != ident && n.decls[name] {
+		return "const_" + hashing.HashWith(getSalt(), name)
+	}
+	// Both the type and its fields may have underscores.
+	for i := strings.Index(ident, "_"); i > 0; i = nextIndex(ident, "_", i) {
+		typeName, rest := ident[:i], ident[i+1:]
+		fields, ok := n.structs[typeName]
+		if !ok {
+			continue
+		}
+		hashedType := typeName
+		if n.decls[typeName] {
+			hashedType = hashing.HashWith(getSalt(), typeName)
+		}
+		if rest == "_size" {
+			return hashedType + "__size"
+		}
+		if hashed, ok := fields[rest]; ok {
+			if hashed {
+				rest = hashing.HashWith(getSalt(), rest)
+			}
+			return hashedType + "_" + rest
+		}
+	}
+	return ident
+}
+
+func nextIndex(s, sep string, after int) int {
+	i := strings.Index(s[after+1:], sep)
+	if i < 0 {
+		return -1
+	}
+	return after + 1 + i
+}
+
+// asmGoFiles returns the Go files of the packages with assembly, as listed by
+// 'go list' for the build, so that build constraints and GOOS or GOARCH
+// suffixes are followed. Test variants are left out, as assembly can't refer
+// to the names in test files.
+func asmGoFiles(pkgs []listedPackage) map[string]bool {
+	files := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if len(pkg.SFiles) == 0 || pkg.Standard || strings.Contains(pkg.ImportPath, " [") {
+			continue
+		}
+		for _, name := range pkg.files() {
+			files[name] = true
+		}
+	}
+	return files
+}
+
+// packageGoFiles returns the Go files of the package in dir which has assembly,
+// from $ASM_GO_FILES_FILE. Without it, such as when -toolexec=garble is used
+// directly, go/build picks them for the current GOOS and GOARCH.
+func packageGoFiles(dir string) ([]string, error) {
+	path := os.Getenv("ASM_GO_FILES_FILE")
+	if path == "" {
+		pkg, err := build.ImportDir(dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, name := range append(pkg.GoFiles, pkg.CgoFiles...) {
+			files = append(files, filepath.Join(dir, name))
+		}
+		return files, nil
+	}
+	var files []string
+	for name := range readNames(path) {
+		if name != "" && filepath.Dir(name) == dir {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readAsmNames parses the Go files of the package in dir, and returns the
+// names which assembly can refer to, or nil if the whole package is left as
+// is. Whether each name is hashed is decided by keepsName, like renameIdents
+// does for the compiler. The names kept for a //go:linkname are looked up
+// under pkgPath.
+func readAsmNames(dir, pkgPath string) (*asmNames, error) {
+	paths, err := packageGoFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The directives are found by position, so the files share a file set.
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, path := range paths {
+		file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if packageHasDirective(files, ignoreDirective) {
+		return nil, nil
+	}
+
+	n := &asmNames{
+		decls:   make(map[string]bool),
+		structs: make(map[string]map[string]bool),
+	}
+	directives := collectDirectives(files)
+	hashed := func(name declaredName) bool {
+		return !keepsName(name, directives, pkgPath)
+	}
+	structs := make(map[string]*ast.StructType)
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					n.decls[decl.Name.Name] = hashed(funcDeclName(decl))
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							n.decls[name.Name] = hashed(declaredName{name: name.Name, pos: name.Pos(), topLevel: true})
+						}
+					case *ast.TypeSpec:
+						name := spec.Name
+						n.decls[name.Name] = hashed(declaredName{name: name.Name, pos: name.Pos(), topLevel: true})
+						if st, ok := spec.Type.(*ast.StructType); ok {
+							structs[name.Name] = st
+						}
+					}
+				}
+			}
+		}
+	}
+	// The fields are done once all the types are known, as an embedded
+	// field is hashed along with its type.
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				name := spec.(*ast.TypeSpec).Name.Name
+				if st := structs[name]; st != nil {
+					n.structs[name] = n.fields(file, st, hashed)
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// fields returns the fields of a struct declared in file, and whether each
+// one is hashed.
+func (n *asmNames) fields(file *ast.File, st *ast.StructType, hashed func(declaredName) bool) map[string]bool {
+	fields := make(map[string]bool)
+	for _, field := range st.Fields.List {
+		for _, name := range field.Names {
+			fields[name.Name] = hashed(declaredName{name: name.Name, pos: name.Pos(), field: true})
+		}
+		if len(field.Names) > 0 {
+			continue
+		}
+		// An embedded field is named after its type, and so it's
+		// hashed when the type is.
+		typ := field.Type
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ = star.X
+		}
+		switch typ := typ.(type) {
+		case *ast.Ident:
+			fields[typ.Name] = n.decls[typ.Name] // false for predeclared types
+		case *ast.SelectorExpr:
+			fields[typ.Sel.Name] = embeddedImportHashed(file, typ)
+		}
+	}
+	return fields
+}
+
+// embeddedImportHashed returns whether an embedded field whose type is
+// declared in another package, like pkg.T, is hashed. Only the syntax is
+// available, so it goes by whether the other package is garbled.
+func embeddedImportHashed(file *ast.File, sel *ast.SelectorExpr) bool {
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		if name == x.Name {
+			garbled, _ := shouldGarblePath(path, false)
+			return garbled
+		}
+	}
+	return false
+}
+
+func isCgoName(name string) bool {
+	return strings.HasPrefix(name, "_C") || strings.Contains(name, "_cgo")
+}
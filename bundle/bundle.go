@@ -0,0 +1,110 @@
+// Package bundle encrypts the salt and the symbol map of a build into a single
+// file, so that they can be archived with a release without letting whoever
+// gets hold of them undo the obfuscation.
+//
+// A bundle is an age file, encrypted either with a passphrase, or for an
+// X25519 public key like "age1...". It can thus also be decrypted with
+// "age -d", which prints the JSON contents.
+package bundle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"mvdan.cc/garble/symbolmap"
+)
+
+// Bundle is the decrypted contents of a bundle file.
+type Bundle struct {
+	Salt string         `json:"salt"`
+	Map  *symbolmap.Map `json:"map,omitempty"`
+}
+
+// Write encrypts the bundle to path, with either a passphrase or a recipient
+// public key like "age1...".
+func (b *Bundle) Write(path, passphrase, recipient string) error {
+	plaintext, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	var r age.Recipient
+	switch {
+	case passphrase != "" && recipient != "":
+		return errors.New("A bundle is encrypted with either a passphrase or a recipient, not both")
+	case passphrase != "":
+		if r, err = age.NewScryptRecipient(passphrase); err != nil {
+			return err
+		}
+	case recipient != "":
+		if r, err = age.ParseX25519Recipient(recipient); err != nil {
+			return errors.Wrapf(err, "Invalid recipient %q", recipient)
+		}
+	default:
+		return errors.New("A bundle needs a passphrase or a recipient")
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// Read decrypts a bundle written by Write, with either the passphrase, or the
+// contents of an identity file with one or more "AGE-SECRET-KEY-1..." lines.
+func Read(path, passphrase, identities string) (*Bundle, error) {
+	var ids []age.Identity
+	if passphrase != "" {
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if identities != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(identities))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid identity")
+		}
+		ids = append(ids, parsed...)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("A bundle needs a passphrase or an identity to be decrypted")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, ids...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, errors.New("Could not decrypt the bundle; wrong passphrase or identity")
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Could not read bundle %s", path)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read bundle %s", path)
+	}
+	var b Bundle
+	if err := json.Unmarshal(plaintext, &b); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode bundle %s", path)
+	}
+	return &b, nil
+}
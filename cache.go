@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The go command caches each compiled package by its action ID, which is a
+// hash of the inputs and of the tool's version, as printed by "-V=full". Since
+// that version query goes through -toolexec too, we add our own hash to it, so
+// that garbled packages are only reused by builds with the same garble binary,
+// salt and flags. That's what allows 'garble build' to not force -a.
+
+// cacheEnvVars are the settings passed on to the toolexec processes which
+// change the garbled output, and thus need to be part of the action ID.
+var cacheEnvVars = []string{
+	"SALT",
+	"ONLY",
+	"INCLUDE",
+	"EXCLUDE",
+	"SKIP_STRINGS",
+	"LITERALS",
+	"OBFUSCATE_LINES",
+	"OBFUSCATE_IMPORT_PATHS",
+	"CONTROL_FLOW",
+	"PACKAGE_OVERRIDES",
+}
+
+// cacheEnvFiles are like cacheEnvVars, but hold paths to files whose contents
+// change the garbled output.
+var cacheEnvFiles = []string{
+	"KEEP_METHODS_FILE",
+	"KEEP_FIELDS_FILE",
+	"KEEP_LINKNAMES_FILE",
+}
+
+// isToolVersion returns whether a tool is being asked for its version, which
+// the go command uses as part of its action IDs.
+func isToolVersion(args []string) bool {
+	return len(args) == 1 && args[0] == "-V=full"
+}
+
+// runToolVersion runs the tool with -V=full, and prints its version with our
+// own hash added.
+func runToolVersion(tool string, args []string) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	id, err := garbleActionID()
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(string(out))
+
+	// For released versions, the whole line is used. For development
+	// versions, only the content ID at the end of the last "buildID=" field
+	// is used, so ours must go last and take that form.
+	_, err = fmt.Printf("%s +garble buildID=_/_/_/%s\n", line, id)
+	return err
+}
+
+// garbleActionID returns a hash of the garble binary and of all the settings
+// which affect the garbled output.
+func garbleActionID() (string, error) {
+	h := sha256.New()
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(execPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	// Settings left at their defaults are left out, so that using
+	// -toolexec=garble directly, without any of them set, shares the same
+	// IDs as 'garble build'.
+	for _, name := range cacheEnvVars {
+		value := os.Getenv(name)
+		if value == "" || value == "FALSE" {
+			continue
+		}
+		fmt.Fprintf(h, "%s=%s\n", name, value)
+	}
+	for _, name := range cacheEnvFiles {
+		path := os.Getenv(name)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if len(data) == 0 {
+			continue // no names to keep, like without the file
+		}
+		fmt.Fprintf(h, "%s=%x\n", name, sha256.Sum256(data))
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:15]), nil
+}
+
+// mapCacheDir returns the directory where each compiled package writes the
+// names it hashed. It must outlive the build, since a package pulled from the
+// build cache isn't compiled again, so it lives inside the build cache.
+func mapCacheDir() (string, error) {
+	out, err := exec.Command("go", "env", "GOCACHE").Output()
+	if err != nil {
+		return "", fmt.Errorf("go env error: %v", err)
+	}
+	gocache := string(bytes.TrimSpace(out))
+	if gocache == "" || gocache == "off" {
+		return "", fmt.Errorf("garble requires the build cache; GOCACHE is %q", gocache)
+	}
+	dir := filepath.Join(gocache, "garble", "map")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := trimMapCache(dir, time.Now()); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Like the go build cache, the fragments which haven't been used for a while
+// are removed. MergeFragments updates the mtime of the ones it reads, so the
+// mtime tells when a fragment was last used.
+const (
+	mapTrimInterval = 24 * time.Hour
+	mapTrimLimit    = 5 * 24 * time.Hour
+)
+
+// trimMapCache removes the fragments in dir which haven't been used for
+// mapTrimLimit. The time of the last trim is kept in a file, so that it only
+// happens once every mapTrimInterval.
+func trimMapCache(dir string, now time.Time) error {
+	trimPath := filepath.Join(dir, "trim.txt")
+	if data, err := ioutil.ReadFile(trimPath); err == nil {
+		if last, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil &&
+			now.Sub(time.Unix(last, 0)) < mapTrimInterval {
+			return nil
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-mapTrimLimit)
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".bin") || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		// Another build might be using it; that's fine, as it's
+		// simply written again when its package is next compiled.
+		os.Remove(filepath.Join(dir, info.Name()))
+	}
+	return ioutil.WriteFile(trimPath, []byte(fmt.Sprintf("%d\n", now.Unix())), 0600)
+}
+
+// builtActionIDs returns the action IDs of all the packages in the build,
+// which name their fragments in the map cache directory. All the packages
+// have just been built, so this doesn't compile anything.
+func builtActionIDs(goFlags, patterns []string, test bool) ([]string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	flags := append([]string{"-trimpath", "-toolexec=" + execPath}, goFlags...)
+	pkgs, err := listPackages(flags, patterns, test, true)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, pkg := range pkgs {
+		if pkg.BuildID != "" {
+			ids = append(ids, trimBuildID(pkg.BuildID))
+		}
+	}
+	return ids, nil
+}
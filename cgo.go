@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Cgo writes the C preambles of a package out with #line directives naming
+// the Go files they came from, which the go command then maps to the import
+// path, so that __FILE__ and assert messages in C code show it even with
+// --import-paths. For garbled packages, the cgo tool gets a -trimpath which
+// leaves just the file names.
+//
+// The Go side of the package is garbled by transformCompile, which renames
+// the user's names in cgo's generated files too.
+
+// transformCgo trims the directory of a garbled package from the paths which
+// cgo records.
+func transformCgo(args []string) ([]string, error) {
+	pkgPath := flagValue(args, "-importpath")
+	if pkgPath == "" {
+		return args, nil // also -dynimport, which has no Go files
+	}
+	if garbled, _ := shouldGarblePath(pkgPath, pkgPath == "main"); !garbled {
+		return args, nil
+	}
+	var dir string
+	for _, arg := range args {
+		if strings.HasSuffix(arg, ".go") && filepath.IsAbs(arg) {
+			dir = filepath.Dir(arg)
+			break
+		}
+	}
+	if dir == "" || flagValue(args, "-trimpath") != "" {
+		return args, nil
+	}
+	return append([]string{"-trimpath", dir + "=>"}, args...), nil
+}
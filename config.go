@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	stringsG "mvdan.cc/garble/strings"
+)
+
+// The settings for 'garble build' can also come from a garble.toml or
+// garble.yaml file at the root of the main module, so that scripts don't need
+// long lists of flags. Flags given on the command line win over the file, and
+// 'garble config print' shows the result of merging both.
+
+var configNames = []string{"garble.toml", "garble.yaml", "garble.yml"}
+
+type config struct {
+	Packages  packagesConfig    `toml:"packages" yaml:"packages"`
+	Literals  literalsConfig    `toml:"literals" yaml:"literals"`
+	Salt      saltConfig        `toml:"salt" yaml:"salt"`
+	Output    outputConfig      `toml:"output" yaml:"output"`
+	Build     buildConfig       `toml:"build" yaml:"build"`
+	Overrides []packageOverride `toml:"override" yaml:"override"`
+}
+
+type packagesConfig struct {
+	Only    string   `toml:"only" yaml:"only"`
+	Include []string `toml:"include" yaml:"include"`
+	Exclude []string `toml:"exclude" yaml:"exclude"`
+}
+
+type literalsConfig struct {
+	Skip        bool     `toml:"skip" yaml:"skip"`
+	Obfuscators []string `toml:"obfuscators" yaml:"obfuscators"`
+}
+
+type saltConfig struct {
+	Seed    string `toml:"seed" yaml:"seed"`
+	FromGit bool   `toml:"from-git" yaml:"from-git"`
+	Write   bool   `toml:"write" yaml:"write"`
+}
+
+type outputConfig struct {
+	Map             string `toml:"map" yaml:"map"`
+	CodeDir         string `toml:"code-dir" yaml:"code-dir"`
+	Report          string `toml:"report" yaml:"report"`
+	Bundle          string `toml:"bundle" yaml:"bundle"`
+	BundleRecipient string `toml:"bundle-recipient" yaml:"bundle-recipient"`
+}
+
+type buildConfig struct {
+	Flags           []string `toml:"flags" yaml:"flags"`
+	ControlFlow     bool     `toml:"control-flow" yaml:"control-flow"`
+	ObfuscateLines  bool     `toml:"obfuscate-lines" yaml:"obfuscate-lines"`
+	ImportPaths     bool     `toml:"import-paths" yaml:"import-paths"`
+	ExportedMethods bool     `toml:"exported-methods" yaml:"exported-methods"`
+	ExportedFields  bool     `toml:"exported-fields" yaml:"exported-fields"`
+}
+
+// packageOverride changes the settings which apply to each package on its
+// own, for the packages matching its package patterns. When more than one
+// override matches, the last one wins.
+type packageOverride struct {
+	Packages     []string `toml:"packages" yaml:"packages" json:"packages"`
+	SkipLiterals *bool    `toml:"skip-literals,omitempty" yaml:"skip-literals,omitempty" json:"skipLiterals,omitempty"`
+	Obfuscators  []string `toml:"obfuscators,omitempty" yaml:"obfuscators,omitempty" json:"obfuscators,omitempty"`
+	ControlFlow  *bool    `toml:"control-flow,omitempty" yaml:"control-flow,omitempty" json:"controlFlow,omitempty"`
+}
+
+// findConfig returns the path of the config file at the root of the main
+// module, or an empty string if there's none.
+func findConfig() (string, error) {
+	dir, err := findModuleRoot()
+	if err != nil || dir == "" {
+		return "", err
+	}
+	var found []string
+	for _, name := range configNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", errors.Errorf("Found more than one config file: %s", strings.Join(found, ", "))
+}
+
+// readConfig reads a config file, which must not have any unknown settings,
+// so that typos don't go unnoticed.
+func readConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(config)
+	if isYAML(path) {
+		err = yaml.UnmarshalStrict(data, c)
+	} else {
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = errors.Errorf("unknown setting %q", undecoded[0].String())
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read config file %s", path)
+	}
+	if err := checkObfuscators(c.Literals.Obfuscators); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	for _, o := range c.Overrides {
+		if len(o.Packages) == 0 {
+			return nil, errors.Errorf("%s: each override needs a list of packages", path)
+		}
+		if err := checkObfuscators(o.Obfuscators); err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+	}
+
+	// Paths in the file are relative to it, not to where garble runs.
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&c.Output.Map, &c.Output.CodeDir, &c.Output.Report, &c.Output.Bundle} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return c, nil
+}
+
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// applyConfig sets the flags which weren't given on the command line from the
+// config file.
+func (f *buildFlagSet) applyConfig(c *config) {
+	fs := f.flagSet
+	setString := func(name string, p *string, value string) {
+		if !fs.Changed(name) && value != "" {
+			*p = value
+		}
+	}
+	setList := func(name string, p *[]string, value []string) {
+		if !fs.Changed(name) && len(value) > 0 {
+			*p = value
+		}
+	}
+	setBool := func(name string, p *bool, value bool) {
+		if !fs.Changed(name) && value {
+			*p = value
+		}
+	}
+
+	setString("only", f.only, c.Packages.Only)
+	setList("include", f.include, c.Packages.Include)
+	setList("exclude", f.exclude, c.Packages.Exclude)
+
+	setBool("skip-strings", f.skipStrings, c.Literals.Skip)
+	setList("literals", f.literals, c.Literals.Obfuscators)
+
+	setString("seed", f.seed, c.Salt.Seed)
+	setBool("seed-from-git", f.seedFromGit, c.Salt.FromGit)
+	setBool("write-salt", f.writeSalt, c.Salt.Write)
+
+	setString("map-path", f.mapPath, c.Output.Map)
+	setString("code-out-dir", f.codeOutDir, c.Output.CodeDir)
+	setString("report", f.reportPath, c.Output.Report)
+	setString("bundle-path", f.bundlePath, c.Output.Bundle)
+	setString("bundle-recipient", f.bundleRecipient, c.Output.BundleRecipient)
+
+	if !fs.Changed("go-build-flags") && len(c.Build.Flags) > 0 {
+		f.goFlags = c.Build.Flags
+	}
+	setBool("control-flow", f.controlFlow, c.Build.ControlFlow)
+	setBool("obfuscate-lines", f.obfuscateLines, c.Build.ObfuscateLines)
+	setBool("import-paths", f.importPaths, c.Build.ImportPaths)
+	setBool("exported-methods", f.exportedMethods, c.Build.ExportedMethods)
+	setBool("exported-fields", f.exportedFields, c.Build.ExportedFields)
+
+	f.overrides = c.Overrides
+}
+
+// effectiveConfig returns the settings a build with these flags would use.
+func (f *buildFlagSet) effectiveConfig() *config {
+	c := new(config)
+	c.Packages.Only = *f.only
+	c.Packages.Include = *f.include
+	c.Packages.Exclude = *f.exclude
+	c.Literals.Skip = *f.skipStrings
+	c.Literals.Obfuscators = *f.literals
+	c.Salt.Seed = *f.seed
+	c.Salt.FromGit = *f.seedFromGit
+	c.Salt.Write = *f.writeSalt
+	c.Output.Map = *f.mapPath
+	c.Output.CodeDir = *f.codeOutDir
+	c.Output.Report = *f.reportPath
+	c.Output.Bundle = *f.bundlePath
+	c.Output.BundleRecipient = *f.bundleRecipient
+	c.Build.Flags = f.goFlags
+	c.Build.ControlFlow = *f.controlFlow
+	c.Build.ObfuscateLines = *f.obfuscateLines
+	c.Build.ImportPaths = *f.importPaths
+	c.Build.ExportedMethods = *f.exportedMethods
+	c.Build.ExportedFields = *f.exportedFields
+	c.Overrides = f.overrides
+	return c
+}
+
+// printConfig writes the effective config in the format of the config file,
+// or as TOML if there's none.
+func (f *buildFlagSet) printConfig(w io.Writer) error {
+	c := f.effectiveConfig()
+	if *f.configPath != "" {
+		fmt.Fprintf(w, "# from %s and the command line\n", *f.configPath)
+	}
+	if isYAML(*f.configPath) {
+		data, err := yaml.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func checkObfuscators(names []string) error {
+	known := stringsG.ObfuscatorNames()
+	for _, name := range names {
+		i := sort.SearchStrings(known, name)
+		if i == len(known) || known[i] != name {
+			return errors.Errorf("Unknown literal obfuscator %q; the available ones are: %s", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// applyPackageOverrides sets the settings for the package being compiled
+// from the overrides passed on by 'garble build' in $PACKAGE_OVERRIDES.
+func applyPackageOverrides(pkgPath string) error {
+	data := os.Getenv("PACKAGE_OVERRIDES")
+	if data == "" {
+		return nil
+	}
+	var overrides []packageOverride
+	if err := json.Unmarshal([]byte(data), &overrides); err != nil {
+		return err
+	}
+	for _, o := range overrides {
+		if ok, _ := matchPatterns(o.Packages, pkgPath); !ok {
+			continue
+		}
+		if o.SkipLiterals != nil {
+			os.Setenv("SKIP_STRINGS", envBool(*o.SkipLiterals))
+		}
+		if len(o.Obfuscators) > 0 {
+			os.Setenv("LITERALS", strings.Join(o.Obfuscators, ","))
+		}
+		if o.ControlFlow != nil {
+			os.Setenv("CONTROL_FLOW", envBool(*o.ControlFlow))
+		}
+	}
+	return nil
+}
+
+func envBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/garble/hashing"
+)
+
+// With --control-flow, the body of each function is split into blocks, which
+// become the cases of a switch inside an endless loop. A state variable says
+// which block runs next, and each transition is guarded by an opaque predicate
+// which is always true, with a fake state on the other branch. Fake cases are
+// added as well, so the real order of the blocks isn't obvious.
+//
+// Only the top-level statements of a body are moved, so break, continue,
+// select, defer and recover keep working as before. Local variables are
+// declared upfront, so that they're visible from any block. When that's not
+// possible, as with local types, the statements using them are kept in the
+// same block. Gotos to top-level labels become a change of state.
+
+const noControlFlowDirective = "//garble:nocontrolflow"
+
+// packageHasDirective returns whether any of the files has a directive in the
+// comments above its package clause.
+func packageHasDirective(files []*ast.File, directive string) bool {
+	for _, file := range files {
+		for _, group := range file.Comments {
+			if group.End() > file.Package {
+				break
+			}
+			if hasDirective(group, directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasGoDirective(group *ast.CommentGroup) bool {
+	if group == nil {
+		return false
+	}
+	for _, comment := range group.List {
+		if strings.HasPrefix(comment.Text, "//go:") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDirective(group *ast.CommentGroup, directive string) bool {
+	if group == nil {
+		return false
+	}
+	for _, comment := range group.List {
+		if comment.Text == directive || strings.HasPrefix(comment.Text, directive+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenControlFlow flattens every function declared in the file, except
+// those with //garble:nocontrolflow or //garble:ignore, and those with any
+// //go: directive, since those tend to limit what the function may do, like
+// growing its stack.
+func flattenControlFlow(file *ast.File, info *types.Info, pkg *types.Package) {
+	name := filepath.Base(fset.Position(file.Pos()).Filename)
+	if strings.HasPrefix(name, "_cgo_") {
+		return
+	}
+	imports := make(map[string]*types.PkgName)
+	for _, spec := range file.Imports {
+		obj := info.Implicits[spec]
+		if spec.Name != nil {
+			obj = info.Defs[spec.Name]
+		}
+		if pkgName, ok := obj.(*types.PkgName); ok {
+			imports[pkgName.Imported().Path()] = pkgName
+		}
+	}
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Body == nil || hasDirective(fd.Doc, noControlFlowDirective) || hasDirective(fd.Doc, ignoreDirective) {
+			continue
+		}
+		if hasGoDirective(fd.Doc) {
+			continue
+		}
+		line := fset.Position(fd.Pos()).Line
+		f := &flattener{
+			info:    info,
+			pkg:     pkg,
+			imports: imports,
+			scope:   info.Scopes[fd.Type],
+			rnd:     rand.New(rand.NewSource(hashing.SeedWith(getSalt(), fmt.Sprintf("%s %s:%d", pkg.Path(), name, line)))),
+		}
+		if f.scope == nil {
+			continue
+		}
+		f.flatten(fd)
+	}
+}
+
+type flattener struct {
+	info    *types.Info
+	pkg     *types.Package
+	imports map[string]*types.PkgName
+	scope   *types.Scope // the function's scope
+	rnd     *rand.Rand
+
+	state     *types.Var
+	stateName string
+	loopLabel string
+}
+
+// flatten rewrites the body of fd, unless there's nothing to gain or it's not
+// possible to do safely.
+func (f *flattener) flatten(fd *ast.FuncDecl) {
+	intType, ok := f.ident("int", types.Universe.Lookup("int"))
+	if !ok {
+		return // shadowed
+	}
+	stmts := fd.Body.List
+
+	// Find the top-level labels which are the target of a goto. Those must
+	// start a block, and their gotos become jumps to that block's state.
+	gotos := make(map[string]bool)
+	branches := make(map[string]bool)
+	inspectBody(fd.Body, func(node ast.Node) {
+		if branch, ok := node.(*ast.BranchStmt); ok && branch.Label != nil {
+			if branch.Tok == token.GOTO {
+				gotos[branch.Label.Name] = true
+			} else {
+				branches[branch.Label.Name] = true
+			}
+		}
+	})
+	labelStmts := make(map[string]int)
+	for i, stmt := range stmts {
+		for labeled, ok := stmt.(*ast.LabeledStmt); ok; labeled, ok = labeled.Stmt.(*ast.LabeledStmt) {
+			if gotos[labeled.Label.Name] {
+				labelStmts[labeled.Label.Name] = i
+			}
+		}
+	}
+
+	// Declare the local variables upfront where possible. Any other local
+	// declaration forces the statements up to its last use into one block.
+	var hoisted []*types.Var
+	lastUse := make(map[types.Object]int)
+	for i, stmt := range stmts {
+		inspectAll(stmt, func(node ast.Node) {
+			if id, ok := node.(*ast.Ident); ok {
+				if obj := f.info.Uses[id]; obj != nil {
+					lastUse[obj] = i
+				}
+			}
+		})
+	}
+	replaced := make(map[int][]ast.Stmt)
+	maxLive := make([]int, len(stmts)) // last statement using a local declared up to each one
+	live := -1
+	for i, stmt := range stmts {
+		// A goto to a label up to a declaration may run it again, which
+		// declares new variables each time, such as for the closures
+		// capturing them. Declared upfront, they would be shared.
+		rerun := false
+		for _, j := range labelStmts {
+			if j <= i {
+				rerun = true
+			}
+		}
+		vars, others := f.declared(unlabel(stmt))
+		if len(vars) > 0 {
+			if repl, ok := f.hoist(stmts, i, vars); ok && !rerun {
+				hoisted = append(hoisted, vars...)
+				replaced[i] = repl
+			} else {
+				if f.redeclares(unlabel(stmt), hoisted) {
+					// it would declare a new variable in its
+					// block, instead of assigning to the old one
+					return
+				}
+				for _, v := range vars {
+					others = append(others, v)
+				}
+			}
+		}
+		for _, obj := range others {
+			if last, ok := lastUse[obj]; ok && last > live {
+				live = last
+			}
+		}
+		maxLive[i] = live
+	}
+
+	// Split the statements into blocks, wherever no local variable which
+	// couldn't be declared upfront is used across the split.
+	var blocks [][]ast.Stmt
+	blockOf := make(map[int]int)
+	for i, stmt := range stmts {
+		if i == 0 || maxLive[i-1] < i {
+			blocks = append(blocks, nil)
+		} else if _, ok := labelInStmt(stmt, labelStmts); ok {
+			return // a goto target in the middle of a block
+		}
+		blockOf[i] = len(blocks) - 1
+		last := len(blocks) - 1
+		if repl, ok := replaced[i]; ok {
+			// only gotos can refer to the label of a declaration
+			blocks[last] = append(blocks[last], repl...)
+		} else {
+			blocks[last] = append(blocks[last], dropLabels(stmt, labelStmts, branches))
+		}
+	}
+	if len(blocks) < 2 {
+		return
+	}
+
+	// Every block, and a few fake ones, get a distinct random state.
+	used := make(map[int]bool)
+	newState := func() int {
+		for {
+			n := 1 + f.rnd.Intn(1<<30)
+			if !used[n] {
+				used[n] = true
+				return n
+			}
+		}
+	}
+	states := make([]int, len(blocks))
+	for i := range states {
+		states[i] = newState()
+	}
+	fakes := make([]int, 1+f.rnd.Intn(2))
+	for i := range fakes {
+		fakes[i] = newState()
+	}
+
+	f.stateName = hashing.HashWith(getSalt(), fmt.Sprintf("state %d", states[0]))
+	f.loopLabel = hashing.HashWith(getSalt(), fmt.Sprintf("loop %d", states[0]))
+	f.state = types.NewVar(token.NoPos, f.pkg, f.stateName, types.Typ[types.Int])
+
+	if len(labelStmts) > 0 {
+		for _, block := range blocks {
+			f.rewriteGotos(&ast.BlockStmt{List: block}, func(label string) int {
+				i, ok := labelStmts[label]
+				if !ok {
+					return 0
+				}
+				return states[blockOf[i]]
+			})
+		}
+	}
+
+	var clauses []ast.Stmt
+	results := fd.Type.Results != nil && len(fd.Type.Results.List) > 0
+	for i, block := range blocks {
+		body := block
+		switch {
+		case i+1 < len(blocks):
+			body = append(body, f.transition(states[i+1], fakes[f.rnd.Intn(len(fakes))]))
+		case !results:
+			body = append(body, &ast.ReturnStmt{})
+		}
+		clauses = append(clauses, &ast.CaseClause{List: []ast.Expr{intLit(states[i])}, Body: body})
+	}
+	for _, fake := range fakes {
+		clauses = append(clauses, &ast.CaseClause{
+			List: []ast.Expr{intLit(fake)},
+			Body: []ast.Stmt{f.assignState(states[f.rnd.Intn(len(states))])},
+		})
+	}
+	f.rnd.Shuffle(len(clauses), func(i, j int) {
+		clauses[i], clauses[j] = clauses[j], clauses[i]
+	})
+
+	var body []ast.Stmt
+	for _, v := range hoisted {
+		typ, _ := f.typeExpr(v.Type())
+		name := ast.NewIdent(v.Name())
+		f.info.Uses[name] = v
+		body = append(body, &ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{name}, Type: typ}},
+		}})
+	}
+	body = append(body, &ast.DeclStmt{Decl: &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{
+			Names:  []*ast.Ident{f.stateIdent()},
+			Type:   intType,
+			Values: []ast.Expr{intLit(states[0])},
+		}},
+	}})
+	var loop ast.Stmt = &ast.ForStmt{Body: &ast.BlockStmt{List: []ast.Stmt{
+		&ast.SwitchStmt{Tag: f.stateIdent(), Body: &ast.BlockStmt{List: clauses}},
+	}}}
+	if len(labelStmts) > 0 {
+		loop = &ast.LabeledStmt{Label: ast.NewIdent(f.loopLabel), Stmt: loop}
+	}
+	fd.Body.List = append(body, loop)
+}
+
+// declared returns the objects declared by a top-level statement; the
+// variables, which may be declared upfront, and the rest.
+func (f *flattener) declared(stmt ast.Stmt) (vars []*types.Var, others []types.Object) {
+	switch stmt := stmt.(type) {
+	case *ast.AssignStmt:
+		if stmt.Tok != token.DEFINE {
+			return nil, nil
+		}
+		for _, expr := range stmt.Lhs {
+			if id, ok := expr.(*ast.Ident); ok {
+				if v, ok := f.info.Defs[id].(*types.Var); ok {
+					vars = append(vars, v)
+				}
+			}
+		}
+	case *ast.DeclStmt:
+		decl := stmt.Decl.(*ast.GenDecl)
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.ValueSpec:
+				for _, id := range spec.Names {
+					obj := f.info.Defs[id]
+					if v, ok := obj.(*types.Var); ok && decl.Tok == token.VAR {
+						vars = append(vars, v)
+					} else if obj != nil {
+						others = append(others, obj)
+					}
+				}
+			case *ast.TypeSpec:
+				if obj := f.info.Defs[spec.Name]; obj != nil {
+					others = append(others, obj)
+				}
+			}
+		}
+	}
+	return vars, others
+}
+
+// hoist returns the statements replacing the declaration of vars at index i,
+// once they are declared upfront, or false if that would change their meaning.
+func (f *flattener) hoist(stmts []ast.Stmt, i int, vars []*types.Var) ([]ast.Stmt, bool) {
+	if _, ok := f.ident("new", types.Universe.Lookup("new")); !ok {
+		return nil, false
+	}
+	for _, v := range vars {
+		if _, ok := f.typeExpr(v.Type()); !ok {
+			return nil, false
+		}
+		// Any earlier use of the same name refers to something outside
+		// the function, which the upfront declaration would shadow.
+		shadows := false
+		for _, stmt := range stmts[:i+1] {
+			inspectAll(stmt, func(node ast.Node) {
+				if id, ok := node.(*ast.Ident); ok && id.Name == v.Name() {
+					if obj := f.info.Uses[id]; obj != nil && f.outside(obj) {
+						shadows = true
+					}
+				}
+			})
+		}
+		if shadows {
+			return nil, false
+		}
+	}
+
+	switch stmt := unlabel(stmts[i]).(type) {
+	case *ast.AssignStmt:
+		assign := *stmt
+		assign.Tok = token.ASSIGN
+		return []ast.Stmt{&assign}, true
+	case *ast.DeclStmt:
+		var repl []ast.Stmt
+		for _, spec := range stmt.Decl.(*ast.GenDecl).Specs {
+			spec := spec.(*ast.ValueSpec)
+			var lhs, rhs []ast.Expr
+			for _, id := range spec.Names {
+				lhs = append(lhs, id)
+			}
+			if len(spec.Values) > 0 {
+				rhs = spec.Values
+			} else {
+				// A goto may run the declaration again, which
+				// resets the variables to their zero values.
+				for _, id := range spec.Names {
+					obj := f.info.Defs[id]
+					if obj == nil {
+						lhs = lhs[1:]
+						continue
+					}
+					typ, _ := f.typeExpr(obj.Type())
+					newIdent, _ := f.ident("new", types.Universe.Lookup("new"))
+					rhs = append(rhs, &ast.StarExpr{X: &ast.CallExpr{
+						Fun:  newIdent,
+						Args: []ast.Expr{typ},
+					}})
+				}
+				if len(lhs) == 0 {
+					continue
+				}
+			}
+			repl = append(repl, &ast.AssignStmt{Lhs: lhs, Tok: token.ASSIGN, Rhs: rhs})
+		}
+		return repl, true
+	}
+	return nil, false
+}
+
+// outside returns whether obj is declared in a scope enclosing the function,
+// such as the package or the universe.
+func (f *flattener) outside(obj types.Object) bool {
+	for scope := f.scope.Parent(); scope != nil; scope = scope.Parent() {
+		if obj.Parent() == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// redeclares returns whether stmt is a short variable declaration which
+// reuses any of the variables declared upfront.
+func (f *flattener) redeclares(stmt ast.Stmt, hoisted []*types.Var) bool {
+	assign, ok := stmt.(*ast.AssignStmt)
+	if !ok || assign.Tok != token.DEFINE {
+		return false
+	}
+	for _, expr := range assign.Lhs {
+		id, ok := expr.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		for _, v := range hoisted {
+			if f.info.Uses[id] == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// transition returns the statement moving on to the next state, behind an
+// opaque predicate which always holds.
+func (f *flattener) transition(next, fake int) ast.Stmt {
+	var cond ast.Expr
+	switch f.rnd.Intn(2) {
+	case 0: // x*(x+1) is always even
+		cond = &ast.BinaryExpr{
+			X: &ast.BinaryExpr{
+				X: &ast.BinaryExpr{
+					X:  f.stateIdent(),
+					Op: token.MUL,
+					Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: f.stateIdent(), Op: token.ADD, Y: intLit(1)}},
+				},
+				Op: token.REM,
+				Y:  intLit(2),
+			},
+			Op: token.EQL,
+			Y:  intLit(0),
+		}
+	default: // squares are never 2 modulo 4
+		cond = &ast.BinaryExpr{
+			X: &ast.BinaryExpr{
+				X:  &ast.BinaryExpr{X: f.stateIdent(), Op: token.MUL, Y: f.stateIdent()},
+				Op: token.REM,
+				Y:  intLit(4),
+			},
+			Op: token.NEQ,
+			Y:  intLit(2),
+		}
+	}
+	return &ast.IfStmt{
+		Cond: cond,
+		Body: &ast.BlockStmt{List: []ast.Stmt{f.assignState(next)}},
+		Else: &ast.BlockStmt{List: []ast.Stmt{f.assignState(fake)}},
+	}
+}
+
+func (f *flattener) assignState(state int) ast.Stmt {
+	return &ast.AssignStmt{Lhs: []ast.Expr{f.stateIdent()}, Tok: token.ASSIGN, Rhs: []ast.Expr{intLit(state)}}
+}
+
+// stateIdent returns a new reference to the state variable. Like every
+// identifier we add, it's recorded as a use of its object, so that transformGo
+// garbles it like the rest.
+func (f *flattener) stateIdent() *ast.Ident {
+	id := ast.NewIdent(f.stateName)
+	f.info.Uses[id] = f.state
+	return id
+}
+
+// rewriteGotos replaces the gotos to top-level labels with a jump to the state
+// of the label's block.
+func (f *flattener) rewriteGotos(stmt ast.Stmt, stateOf func(label string) int) {
+	inspectBody(stmt, func(node ast.Node) {
+		var list []ast.Stmt
+		switch node := node.(type) {
+		case *ast.BlockStmt:
+			list = node.List
+		case *ast.CaseClause:
+			list = node.Body
+		case *ast.CommClause:
+			list = node.Body
+		case *ast.LabeledStmt:
+			if stmt := f.gotoJump(node.Stmt, stateOf); stmt != nil {
+				node.Stmt = stmt
+			}
+			return
+		default:
+			return
+		}
+		for i, stmt := range list {
+			if jump := f.gotoJump(stmt, stateOf); jump != nil {
+				list[i] = jump
+			}
+		}
+	})
+}
+
+func (f *flattener) gotoJump(stmt ast.Stmt, stateOf func(label string) int) ast.Stmt {
+	branch, ok := stmt.(*ast.BranchStmt)
+	if !ok || branch.Tok != token.GOTO {
+		return nil
+	}
+	state := stateOf(branch.Label.Name)
+	if state == 0 {
+		return nil // not a top-level label
+	}
+	return &ast.BlockStmt{List: []ast.Stmt{
+		f.assignState(state),
+		&ast.BranchStmt{Tok: token.CONTINUE, Label: ast.NewIdent(f.loopLabel)},
+	}}
+}
+
+// typeExpr returns an expression for a type, as long as it can be written in
+// the function's scope. That's not the case for local types, nor for types
+// from packages which the file doesn't import.
+func (f *flattener) typeExpr(typ types.Type) (ast.Expr, bool) {
+	switch typ := types.Unalias(typ).(type) {
+	case *types.Basic:
+		if typ.Kind() == types.UnsafePointer {
+			return f.qualified(types.Unsafe.Scope().Lookup("Pointer"))
+		}
+		if typ.Info()&types.IsUntyped != 0 {
+			return nil, false
+		}
+		return f.ident(typ.Name(), types.Universe.Lookup(typ.Name()))
+	case *types.Named:
+		obj := typ.Obj()
+		if obj.Pkg() != nil && obj.Parent() != obj.Pkg().Scope() {
+			return nil, false // a local type
+		}
+		expr, ok := f.qualified(obj)
+		if !ok {
+			return nil, false
+		}
+		args := typ.TypeArgs()
+		if args.Len() == 0 {
+			return expr, true
+		}
+		var indices []ast.Expr
+		for i := 0; i < args.Len(); i++ {
+			index, ok := f.typeExpr(args.At(i))
+			if !ok {
+				return nil, false
+			}
+			indices = append(indices, index)
+		}
+		if len(indices) == 1 {
+			return &ast.IndexExpr{X: expr, Index: indices[0]}, true
+		}
+		return &ast.IndexListExpr{X: expr, Indices: indices}, true
+	case *types.TypeParam:
+		return f.ident(typ.Obj().Name(), typ.Obj())
+	case *types.Pointer:
+		elem, ok := f.typeExpr(typ.Elem())
+		return &ast.StarExpr{X: elem}, ok
+	case *types.Slice:
+		elem, ok := f.typeExpr(typ.Elem())
+		return &ast.ArrayType{Elt: elem}, ok
+	case *types.Array:
+		elem, ok := f.typeExpr(typ.Elem())
+		length := &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(typ.Len(), 10)}
+		return &ast.ArrayType{Len: length, Elt: elem}, ok
+	case *types.Map:
+		key, ok1 := f.typeExpr(typ.Key())
+		elem, ok2 := f.typeExpr(typ.Elem())
+		return &ast.MapType{Key: key, Value: elem}, ok1 && ok2
+	case *types.Chan:
+		if inner, ok := typ.Elem().(*types.Chan); ok && inner.Dir() == types.RecvOnly {
+			return nil, false // would need parentheses
+		}
+		elem, ok := f.typeExpr(typ.Elem())
+		dir := ast.SEND | ast.RECV
+		switch typ.Dir() {
+		case types.SendOnly:
+			dir = ast.SEND
+		case types.RecvOnly:
+			dir = ast.RECV
+		}
+		return &ast.ChanType{Dir: dir, Value: elem}, ok
+	case *types.Signature:
+		if typ.TypeParams().Len() > 0 {
+			return nil, false
+		}
+		params, ok1 := f.fieldList(typ.Params(), typ.Variadic())
+		results, ok2 := f.fieldList(typ.Results(), false)
+		return &ast.FuncType{Params: params, Results: results}, ok1 && ok2
+	case *types.Interface:
+		if !typ.Empty() {
+			return nil, false
+		}
+		return &ast.InterfaceType{Methods: &ast.FieldList{}}, true
+	case *types.Struct:
+		if typ.NumFields() > 0 {
+			return nil, false
+		}
+		return &ast.StructType{Fields: &ast.FieldList{}}, true
+	}
+	return nil, false
+}
+
+func (f *flattener) fieldList(tuple *types.Tuple, variadic bool) (*ast.FieldList, bool) {
+	list := &ast.FieldList{}
+	for i := 0; i < tuple.Len(); i++ {
+		typ := tuple.At(i).Type()
+		if variadic && i == tuple.Len()-1 {
+			elem, ok := f.typeExpr(typ.(*types.Slice).Elem())
+			if !ok {
+				return nil, false
+			}
+			list.List = append(list.List, &ast.Field{Type: &ast.Ellipsis{Elt: elem}})
+			continue
+		}
+		expr, ok := f.typeExpr(typ)
+		if !ok {
+			return nil, false
+		}
+		list.List = append(list.List, &ast.Field{Type: expr})
+	}
+	return list, true
+}
+
+// qualified returns a reference to a package-level object, qualified with the
+// import name if it's from another package.
+func (f *flattener) qualified(obj types.Object) (ast.Expr, bool) {
+	if obj.Pkg() == nil || obj.Pkg() == f.pkg {
+		return f.ident(obj.Name(), obj)
+	}
+	pkgName, ok := f.imports[obj.Pkg().Path()]
+	if !ok || !obj.Exported() {
+		return nil, false
+	}
+	x, ok := f.ident(pkgName.Name(), pkgName)
+	if !ok {
+		return nil, false
+	}
+	sel := ast.NewIdent(obj.Name())
+	f.info.Uses[sel] = obj
+	return &ast.SelectorExpr{X: x, Sel: sel}, true
+}
+
+// ident returns a reference to obj by name, as long as the name refers to
+// obj anywhere in the function.
+func (f *flattener) ident(name string, obj types.Object) (*ast.Ident, bool) {
+	if _, found := f.scope.LookupParent(name, token.NoPos); found != obj {
+		return nil, false
+	}
+	id := ast.NewIdent(name)
+	f.info.Uses[id] = obj
+	return id, true
+}
+
+func intLit(n int) *ast.BasicLit {
+	return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+}
+
+func unlabel(stmt ast.Stmt) ast.Stmt {
+	for {
+		labeled, ok := stmt.(*ast.LabeledStmt)
+		if !ok {
+			return stmt
+		}
+		stmt = labeled.Stmt
+	}
+}
+
+func labelInStmt(stmt ast.Stmt, labels map[string]int) (string, bool) {
+	for labeled, ok := stmt.(*ast.LabeledStmt); ok; labeled, ok = labeled.Stmt.(*ast.LabeledStmt) {
+		if _, ok := labels[labeled.Label.Name]; ok {
+			return labeled.Label.Name, true
+		}
+	}
+	return "", false
+}
+
+// dropLabels removes the top-level labels which were only used by gotos, as
+// they'd be left unused.
+func dropLabels(stmt ast.Stmt, gotoLabels map[string]int, branches map[string]bool) ast.Stmt {
+	labeled, ok := stmt.(*ast.LabeledStmt)
+	if !ok {
+		return stmt
+	}
+	inner := dropLabels(labeled.Stmt, gotoLabels, branches)
+	if _, ok := gotoLabels[labeled.Label.Name]; ok && !branches[labeled.Label.Name] {
+		return inner
+	}
+	labeled.Stmt = inner
+	return labeled
+}
+
+// inspectBody walks a function body, without entering function literals,
+// which have their own labels.
+func inspectBody(node ast.Node, fn func(ast.Node)) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		if _, ok := node.(*ast.FuncLit); ok {
+			return false
+		}
+		if node != nil {
+			fn(node)
+		}
+		return true
+	})
+}
+
+func inspectAll(node ast.Node, fn func(ast.Node)) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node != nil {
+			fn(node)
+		}
+		return true
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// Directives in the source let code opt out of parts of the obfuscation, so
+// that a library can ship code which garbles correctly without every user
+// having to know which packages to exclude:
+//
+//	//garble:ignore     on a declaration, nothing in it is obfuscated
+//	//garble:keepname   on a declaration or a field, its names are kept
+//	//garble:nostrings  on a function or declaration, its literals are kept
+//
+// Above the package clause of any file, such as doc.go, //garble:ignore
+// leaves the whole package as is, and //garble:nostrings keeps all of its
+// literals.
+const (
+	ignoreDirective    = "//garble:ignore"
+	keepNameDirective  = "//garble:keepname"
+	noStringsDirective = "//garble:nostrings"
+)
+
+// sourceDirectives holds what the directives in a package ask for.
+type sourceDirectives struct {
+	// kept holds the positions of the identifiers declaring the names to
+	// keep. Positions work both for the objects of the type-checked
+	// package, and for the syntax alone, as the assembly side has it.
+	kept map[token.Pos]bool
+
+	// keptMembers holds the names of the fields and methods to keep. Like
+	// with --exported-methods and --exported-fields, they're kept by name,
+	// so that a kept method still implements an interface, and struct
+	// conversions between types with the same fields keep working.
+	keptMembers map[string]bool
+
+	// skipLiterals holds the declarations whose literals are left alone.
+	skipLiterals map[ast.Node]bool
+}
+
+// collectDirectives finds the directives on the declarations and fields of
+// a package, whose files must share a file set.
+func collectDirectives(files []*ast.File) *sourceDirectives {
+	d := &sourceDirectives{
+		kept:         make(map[token.Pos]bool),
+		keptMembers:  make(map[string]bool),
+		skipLiterals: make(map[ast.Node]bool),
+	}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				d.apply(decl, decl.Doc, decl.Name)
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					var names []*ast.Ident
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						names = []*ast.Ident{spec.Name}
+					case *ast.ValueSpec:
+						names = spec.Names
+					default:
+						continue // imports
+					}
+					doc, comment := specComments(spec)
+					for _, group := range []*ast.CommentGroup{decl.Doc, doc, comment} {
+						d.apply(spec, group, names...)
+					}
+				}
+			}
+		}
+		collectKeptMembers(file, false, d.keptMembers)
+	}
+	return d
+}
+
+// apply records the directives in a comment group attached to node, which
+// declares names.
+func (d *sourceDirectives) apply(node ast.Node, group *ast.CommentGroup, names ...*ast.Ident) {
+	if hasDirective(group, ignoreDirective) {
+		d.skipLiterals[node] = true
+		// Only the identifiers which declare something are looked up.
+		ast.Inspect(node, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok {
+				d.kept[id.Pos()] = true
+			}
+			return true
+		})
+	}
+	if hasDirective(group, keepNameDirective) {
+		for _, name := range names {
+			d.kept[name.Pos()] = true
+		}
+	}
+	if hasDirective(group, noStringsDirective) {
+		d.skipLiterals[node] = true
+	}
+}
+
+// collectKeptMembers adds the names of the fields and methods kept by the
+// directives in a file, or of all of them if all is set. It only needs the
+// syntax, so that the analyses for --exported-methods and --exported-fields
+// can use it too.
+func collectKeptMembers(file *ast.File, all bool, kept map[string]bool) {
+	keepAll := func(node ast.Node) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			var fields *ast.FieldList
+			switch node := node.(type) {
+			case *ast.FuncDecl:
+				if node.Recv != nil {
+					kept[node.Name.Name] = true
+				}
+			case *ast.StructType:
+				fields = node.Fields
+			case *ast.InterfaceType:
+				fields = node.Methods
+			}
+			if fields != nil {
+				for _, field := range fields.List {
+					for _, name := range field.Names {
+						kept[name.Name] = true
+					}
+				}
+			}
+			return true
+		})
+	}
+	if all {
+		keepAll(file)
+		return
+	}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if hasDirective(decl.Doc, ignoreDirective) {
+				keepAll(decl)
+			} else if decl.Recv != nil && hasDirective(decl.Doc, keepNameDirective) {
+				kept[decl.Name.Name] = true
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				doc, comment := specComments(spec)
+				if hasDirective(decl.Doc, ignoreDirective) || hasDirective(doc, ignoreDirective) || hasDirective(comment, ignoreDirective) {
+					keepAll(spec)
+				}
+			}
+		}
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		field, ok := node.(*ast.Field)
+		if !ok {
+			return true
+		}
+		for _, group := range []*ast.CommentGroup{field.Doc, field.Comment} {
+			if hasDirective(group, keepNameDirective) || hasDirective(group, ignoreDirective) {
+				for _, name := range field.Names {
+					kept[name.Name] = true
+				}
+			}
+		}
+		return true
+	})
+}
+
+func specComments(spec ast.Spec) (doc, comment *ast.CommentGroup) {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Doc, spec.Comment
+	case *ast.ValueSpec:
+		return spec.Doc, spec.Comment
+	}
+	return nil, nil
+}
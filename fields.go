@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exported fields are only garbled on types which can't reach reflection,
+// such as encoding/json or text/template. Like with methods, 'garble build'
+// runs the analysis upfront, and passes on the names of the fields to keep via
+// $KEEP_FIELDS_FILE. Field names are kept by name, so that the same name is
+// either kept or garbled in every type and package, which keeps struct
+// conversions between types with the same fields working. The same analysis
+// keeps the exported methods of those types, which templates and net/rpc
+// call by name.
+
+// keptFields is loaded from $KEEP_FIELDS_FILE on first use.
+var keptFields map[string]bool
+
+// printPackages only use reflection to print values, so passing values to
+// them doesn't keep their field names. Printing with %+v shows the hashed
+// names instead, which 'garble ungarble --all-names' can reverse.
+var printPackages = map[string]bool{
+	"fmt": true,
+	"log": true,
+}
+
+type fieldAnalysis struct {
+	info *types.Info
+
+	// analyzed holds the packages we type-checked from source
+	analyzed map[string]bool
+
+	kept    map[string]bool   // field names to keep
+	methods map[string]bool   // method names to keep
+	reasons map[string]string // why each kept type was kept
+	seen    map[string]bool
+}
+
+// collectKeptFields type-checks every non-standard package in the build, and
+// returns the names of all the fields and exported methods which must not be
+// renamed, along with a report of which types were kept and why.
+//
+// A type keeps its field names if any of its fields has a struct tag, or if
+// it's converted to an interface anywhere in the build, which is how values
+// reach reflection. Generic type arguments are kept too, since the conversion
+// may happen inside the generic code. Any type reachable from the fields of a
+// kept type is also kept, as reflection follows them. Kept types keep their
+// exported methods too, including the ones with pointer receivers.
+func collectKeptFields(pkgs []listedPackage) (fields, methods map[string]bool, report []byte, err error) {
+	exports := make(map[string]string)
+	for _, pkg := range pkgs {
+		path := plainImportPath(pkg.ImportPath)
+		if _, ok := exports[path]; !ok && pkg.Export != "" {
+			exports[path] = pkg.Export
+		}
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "gc", func(path string) (io.ReadCloser, error) {
+			export, ok := exports[path]
+			if !ok {
+				return nil, fmt.Errorf("could not find export data for %q", path)
+			}
+			return os.Open(export)
+		}),
+		FakeImportC: true,
+	}
+
+	a := &fieldAnalysis{
+		analyzed: make(map[string]bool),
+		kept:     make(map[string]bool),
+		methods:  make(map[string]bool),
+		reasons:  make(map[string]string),
+		seen:     make(map[string]bool),
+	}
+	for _, pkg := range pkgs {
+		if !pkg.Standard {
+			a.analyzed[plainImportPath(pkg.ImportPath)] = true
+		}
+	}
+	for _, pkg := range pkgs {
+		if pkg.Standard || strings.HasSuffix(pkg.ImportPath, ".test") {
+			continue // std isn't garbled, and test mains are generated
+		}
+		var files []*ast.File
+		for _, path := range pkg.files() {
+			file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			files = append(files, file)
+		}
+		// Fields kept by a //garble:keepname or //garble:ignore
+		// directive are kept by name, like the rest, as are all the
+		// fields of the packages we don't garble.
+		garbled := pkg.garbled(files)
+		for _, file := range files {
+			collectKeptMembers(file, !garbled, a.kept)
+		}
+		a.info = &types.Info{
+			Types:     make(map[ast.Expr]types.TypeAndValue),
+			Defs:      make(map[*ast.Ident]types.Object),
+			Uses:      make(map[*ast.Ident]types.Object),
+			Instances: make(map[*ast.Ident]types.Instance),
+		}
+		// Keep going with partial information, since test variants may
+		// not type-check against the non-test export data. The conversions
+		// we can't see might keep any field or method of the package, so
+		// we keep them all.
+		var checkErr error
+		conf.Error = func(err error) {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		conf.Check(plainImportPath(pkg.ImportPath), fset, files, a.info)
+		if checkErr != nil {
+			for _, file := range files {
+				collectKeptMembers(file, true, a.kept)
+				collectKeptMembers(file, true, a.methods)
+			}
+			a.reasons[plainImportPath(pkg.ImportPath)] = "all fields and methods kept, as it failed to type-check: " + checkErr.Error()
+		}
+		for _, file := range files {
+			a.inspectFile(file)
+		}
+		for ident, inst := range a.info.Instances {
+			for i := 0; i < inst.TypeArgs.Len(); i++ {
+				a.keepType(inst.TypeArgs.At(i), "used as a type argument at "+symbolPosition(ident.Pos()))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	var names []string
+	for name := range a.reasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s: %s\n", name, a.reasons[name])
+	}
+	return a.kept, a.methods, buf.Bytes(), nil
+}
+
+// plainImportPath drops the suffix of test variants, like "foo [foo.test]".
+func plainImportPath(path string) string {
+	if i := strings.Index(path, " ["); i > 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// keepType keeps the field and exported method names of t, and of all the
+// types reachable from it.
+func (a *fieldAnalysis) keepType(t types.Type, reason string) {
+	switch t := t.(type) {
+	case *types.Named:
+		name := types.TypeString(t, nil)
+		if a.seen[name] {
+			return
+		}
+		a.seen[name] = true
+		hasMethods := false
+		for i := 0; i < t.NumMethods(); i++ {
+			if method := t.Method(i); method.Exported() {
+				a.methods[method.Name()] = true
+				hasMethods = true
+			}
+		}
+		_, isStruct := t.Underlying().(*types.Struct)
+		if (isStruct || hasMethods) && t.Obj().Pkg() != nil && a.analyzed[t.Obj().Pkg().Path()] {
+			a.reasons[name] = reason
+		}
+		a.keepType(t.Underlying(), "reachable from kept type "+name)
+	case *types.Pointer:
+		a.keepType(t.Elem(), reason)
+	case *types.Slice:
+		a.keepType(t.Elem(), reason)
+	case *types.Array:
+		a.keepType(t.Elem(), reason)
+	case *types.Chan:
+		a.keepType(t.Elem(), reason)
+	case *types.Map:
+		a.keepType(t.Key(), reason)
+		a.keepType(t.Elem(), reason)
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			field := t.Field(i)
+			a.kept[field.Name()] = true
+			a.keepType(field.Type(), reason)
+		}
+	}
+}
+
+// convert records that expr is used as a value of type to, which keeps the
+// type of expr if it's being converted to an interface.
+func (a *fieldAnalysis) convert(to types.Type, expr ast.Expr) {
+	if to == nil || !types.IsInterface(to) {
+		return
+	}
+	from := a.info.TypeOf(expr)
+	if from == nil || types.IsInterface(from) {
+		return
+	}
+	a.keepType(from, fmt.Sprintf("converted to %s at %s", types.TypeString(to, nil), symbolPosition(expr.Pos())))
+}
+
+func (a *fieldAnalysis) inspectFile(file *ast.File) {
+	// the stack of nodes, to find the function a return belongs to
+	var stack []ast.Node
+	ast.Inspect(file, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, node)
+
+		switch node := node.(type) {
+		case *ast.TypeSpec:
+			if st, ok := node.Type.(*ast.StructType); ok && hasTags(st) {
+				a.keepType(a.info.TypeOf(node.Name), "has struct tags")
+			}
+		case *ast.StructType:
+			if hasTags(node) {
+				a.keepType(a.info.TypeOf(node), "has struct tags")
+			}
+		case *ast.CallExpr:
+			a.inspectCall(node)
+		case *ast.AssignStmt:
+			if node.Tok == token.ASSIGN && len(node.Lhs) == len(node.Rhs) {
+				for i, lhs := range node.Lhs {
+					a.convert(a.info.TypeOf(lhs), node.Rhs[i])
+				}
+			}
+		case *ast.ValueSpec:
+			if node.Type != nil {
+				for _, value := range node.Values {
+					a.convert(a.info.TypeOf(node.Type), value)
+				}
+			}
+		case *ast.ReturnStmt:
+			results := a.enclosingResults(stack)
+			if results != nil && results.Len() == len(node.Results) {
+				for i, result := range node.Results {
+					a.convert(results.At(i).Type(), result)
+				}
+			}
+		case *ast.SendStmt:
+			if ch, ok := underlying(a.info.TypeOf(node.Chan)).(*types.Chan); ok {
+				a.convert(ch.Elem(), node.Value)
+			}
+		case *ast.CompositeLit:
+			a.inspectCompositeLit(node)
+		}
+		return true
+	})
+}
+
+func (a *fieldAnalysis) inspectCall(call *ast.CallExpr) {
+	tv := a.info.Types[call.Fun]
+	switch {
+	case tv.IsType():
+		if len(call.Args) == 1 {
+			a.convert(tv.Type, call.Args[0])
+		}
+		return
+	case tv.IsBuiltin():
+		if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == "append" && len(call.Args) > 1 {
+			if slice, ok := underlying(a.info.TypeOf(call.Args[0])).(*types.Slice); ok && !call.Ellipsis.IsValid() {
+				for _, arg := range call.Args[1:] {
+					a.convert(slice.Elem(), arg)
+				}
+			}
+		}
+		return
+	}
+
+	var callee types.Object
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		callee = a.info.Uses[fun]
+	case *ast.SelectorExpr:
+		callee = a.info.Uses[fun.Sel]
+		if (fun.Sel.Name == "FieldByName" || fun.Sel.Name == "MethodByName") && len(call.Args) == 1 {
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if name, err := strconv.Unquote(lit.Value); err == nil {
+					a.kept[name] = true
+				}
+			}
+		}
+	}
+	if callee != nil && callee.Pkg() != nil && printPackages[callee.Pkg().Path()] {
+		return
+	}
+
+	sign, ok := underlying(tv.Type).(*types.Signature)
+	if !ok {
+		return
+	}
+	params := sign.Params()
+	paramType := func(i int) types.Type {
+		if sign.Variadic() && i >= params.Len()-1 {
+			last := params.At(params.Len() - 1).Type()
+			if call.Ellipsis.IsValid() {
+				return last
+			}
+			if slice, ok := underlying(last).(*types.Slice); ok {
+				return slice.Elem()
+			}
+			return nil
+		}
+		if i < params.Len() {
+			return params.At(i).Type()
+		}
+		return nil
+	}
+	if len(call.Args) == 1 {
+		// f(g()), where g returns multiple values
+		if tuple, ok := a.info.TypeOf(call.Args[0]).(*types.Tuple); ok {
+			for i := 0; i < tuple.Len(); i++ {
+				if to := paramType(i); to != nil && types.IsInterface(to) && !types.IsInterface(tuple.At(i).Type()) {
+					a.keepType(tuple.At(i).Type(), fmt.Sprintf("converted to %s at %s",
+						types.TypeString(to, nil), symbolPosition(call.Pos())))
+				}
+			}
+			return
+		}
+	}
+	for i, arg := range call.Args {
+		a.convert(paramType(i), arg)
+	}
+}
+
+func (a *fieldAnalysis) inspectCompositeLit(lit *ast.CompositeLit) {
+	switch t := underlying(a.info.TypeOf(lit)).(type) {
+	case *types.Slice:
+		for _, elt := range lit.Elts {
+			a.convert(t.Elem(), compositeValue(elt))
+		}
+	case *types.Array:
+		for _, elt := range lit.Elts {
+			a.convert(t.Elem(), compositeValue(elt))
+		}
+	case *types.Map:
+		for _, elt := range lit.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				a.convert(t.Key(), kv.Key)
+				a.convert(t.Elem(), kv.Value)
+			}
+		}
+	case *types.Struct:
+		for i, elt := range lit.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				if key, ok := kv.Key.(*ast.Ident); ok {
+					if field := a.info.Uses[key]; field != nil {
+						a.convert(field.Type(), kv.Value)
+					}
+				}
+			} else if i < t.NumFields() {
+				a.convert(t.Field(i).Type(), elt)
+			}
+		}
+	}
+}
+
+// enclosingResults returns the results of the innermost function in stack.
+func (a *fieldAnalysis) enclosingResults(stack []ast.Node) *types.Tuple {
+	for i := len(stack) - 1; i >= 0; i-- {
+		switch node := stack[i].(type) {
+		case *ast.FuncLit:
+			if sign, ok := a.info.TypeOf(node).(*types.Signature); ok {
+				return sign.Results()
+			}
+			return nil
+		case *ast.FuncDecl:
+			if obj := a.info.Defs[node.Name]; obj != nil {
+				return obj.Type().(*types.Signature).Results()
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func compositeValue(elt ast.Expr) ast.Expr {
+	if kv, ok := elt.(*ast.KeyValueExpr); ok {
+		return kv.Value
+	}
+	return elt
+}
+
+func underlying(t types.Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	return t.Underlying()
+}
+
+func hasTags(st *ast.StructType) bool {
+	for _, field := range st.Fields.List {
+		if field.Tag != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// garbleExportedField returns whether an exported field can be renamed,
+// which is never the case unless 'garble build' ran the analysis.
+func garbleExportedField(name string) bool {
+	path := os.Getenv("KEEP_FIELDS_FILE")
+	if path == "" {
+		return false
+	}
+	if keptFields == nil {
+		keptFields = readNames(path)
+	}
+	return !keptFields[name]
+}
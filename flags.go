@@ -1,12 +1,17 @@
 package main
 
 import (
-	"github.com/pkg/errors"
+	"encoding/json"
 	"fmt"
-	flag "github.com/spf13/pflag"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+
+	stringsG "mvdan.cc/garble/strings"
+	"mvdan.cc/garble/ungarble"
 )
 
 type customFlagSet interface {
@@ -15,16 +20,38 @@ type customFlagSet interface {
 }
 
 type buildFlagSet struct {
-	goBuildFlags *string
-	only *string
-	include *[]string
-	exclude *[]string
-	codeOutDir *string
-	skipStrings *bool
-	flagSet *flag.FlagSet
+	goBuildFlags     *string
+	only             *string
+	include          *[]string
+	exclude          *[]string
+	codeOutDir       *string
+	skipStrings      *bool
+	literals         *[]string
+	obfuscateLines   *bool
+	importPaths      *bool
+	controlFlow      *bool
+	exportedMethods  *bool
+	exportedFields   *bool
+	reportPath       *string
+	mapPath          *string
+	seed             *string
+	seedFromGit      *bool
+	writeSalt        *bool
+	bundlePath       *string
+	bundlePassphrase *string
+	bundleRecipient  *string
+	configPath       *string
+	// goFlags are the flags for 'go build', from go-build-flags or the config file
+	goFlags   []string
+	overrides []packageOverride
+	// testFlags are the flags for 'go test' given to 'garble test', such as -run
+	testFlags []string
+	// packageArgs are the packages given to 'garble test', mixed in with the go test flags
+	packageArgs []string
+	flagSet     *flag.FlagSet
 }
 
-func(f *buildFlagSet) fSet() *flag.FlagSet {
+func (f *buildFlagSet) fSet() *flag.FlagSet {
 	return f.flagSet
 }
 
@@ -34,32 +61,176 @@ func (f *buildFlagSet) parse() error {
 	// set env variables more than once, just know that it can't get run twice, because this method
 	// gets run inside of a switch statement in the mainErr func. Tripped myself up here once.
 
-	err := f.flagSet.Parse(os.Args[1:])
+	err := f.parseArgs(os.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	err = f.toEnv()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseArgs parses the flags and merges them with the config file, without
+// passing them on to toolexec, which is all 'garble config print' needs.
+func (f *buildFlagSet) parseArgs(args []string) error {
+	var testBuildFlags []string
+	if len(args) > 0 && args[0] == "test" {
+		args, testBuildFlags = f.splitTestArgs(args)
+	}
+	err := f.flagSet.Parse(args)
 	if err != nil {
-		return fmt.Errorf("Failed to parse args. Err: ", err)
+		return fmt.Errorf("Failed to parse args. Err: %v", err)
 	}
 
+	f.goFlags = strings.Fields(*f.goBuildFlags)
+	if *f.configPath == "" {
+		*f.configPath, err = findConfig()
+		if err != nil {
+			return err
+		}
+	}
+	if *f.configPath != "" {
+		c, err := readConfig(*f.configPath)
+		if err != nil {
+			return err
+		}
+		f.applyConfig(c)
+	}
+	f.goFlags = append(f.goFlags, testBuildFlags...)
+
 	if *f.codeOutDir != "" {
 		*f.codeOutDir, err = filepath.Abs(*f.codeOutDir)
 		if err != nil {
-			return fmt.Errorf("Failed to get absolute path for code-out-dir flag. err: ", err)
+			return fmt.Errorf("Failed to get absolute path for code-out-dir flag. err: %v", err)
 		}
 	}
 
-	err = f.toEnv()
+	if *f.reportPath != "" {
+		*f.reportPath, err = filepath.Abs(*f.reportPath)
+		if err != nil {
+			return errors.Wrap(err, "Failed to get absolute path for report flag")
+		}
+	}
+
+	if *f.mapPath != "" {
+		*f.mapPath, err = filepath.Abs(*f.mapPath)
+		if err != nil {
+			return errors.Wrap(err, "Failed to get absolute path for map-path flag")
+		}
+	}
+
+	*f.bundlePath, err = filepath.Abs(*f.bundlePath)
 	if err != nil {
+		return errors.Wrap(err, "Failed to get absolute path for bundle-path flag")
+	}
+
+	if err := checkObfuscators(*f.literals); err != nil {
 		return err
 	}
+	patterns := append(append([]string{*f.only}, *f.include...), *f.exclude...)
+	if *f.only == "" {
+		patterns = patterns[1:]
+	}
+	for _, o := range f.overrides {
+		patterns = append(patterns, o.Packages...)
+	}
+	if err := checkPatterns(patterns); err != nil {
+		return err
+	}
+
+	if *f.bundlePassphrase == "" {
+		*f.bundlePassphrase = os.Getenv("GARBLE_BUNDLE_PASSPHRASE")
+	}
+	if *f.bundlePassphrase != "" && *f.bundleRecipient != "" {
+		return errors.New("Only one of the bundle-passphrase and bundle-recipient flags can be used")
+	}
+
+	return nil
+}
+
+// packages returns the packages to build, as given after the subcommand.
+func (f *buildFlagSet) packages() []string {
+	args := f.flagSet.Args()[1:]
+	if dash := f.flagSet.ArgsLenAtDash(); dash >= 1 {
+		args = f.flagSet.Args()[1:dash]
+	}
+	return append(args, f.packageArgs...)
+}
 
+// programArgs returns the arguments after --, which 'garble run' passes on to
+// the binary.
+func (f *buildFlagSet) programArgs() []string {
+	if dash := f.flagSet.ArgsLenAtDash(); dash >= 1 {
+		return f.flagSet.Args()[dash:]
+	}
 	return nil
 }
 
+// goTestValueFlags are the flags of 'go test' which take a value, so that the
+// value can be told apart from a package when given as a separate argument.
+var goTestValueFlags = map[string]bool{
+	"asmflags": true, "bench": true, "benchtime": true, "blockprofile": true, "blockprofilerate": true,
+	"count": true, "coverpkg": true, "covermode": true, "coverprofile": true, "cpu": true,
+	"cpuprofile": true, "exec": true, "fuzz": true, "fuzzminimizetime": true, "fuzztime": true,
+	"gcflags": true, "ldflags": true, "list": true, "memprofile": true, "memprofilerate": true,
+	"mod": true, "modfile": true, "mutexprofile": true, "mutexprofilefraction": true, "o": true,
+	"outputdir": true, "overlay": true, "p": true, "parallel": true, "pkgdir": true, "run": true,
+	"shuffle": true, "skip": true, "tags": true, "timeout": true, "trace": true,
+}
+
+// goBuildFlagNames are the flags of 'go test' which are build flags, so that
+// they also reach the 'go list' calls, like the ones in go-build-flags.
+var goBuildFlagNames = map[string]bool{
+	"a": true, "asmflags": true, "gcflags": true, "ldflags": true, "mod": true, "modfile": true,
+	"msan": true, "overlay": true, "p": true, "pkgdir": true, "race": true, "tags": true,
+}
+
+// splitTestArgs splits the arguments to 'garble test' into the garble flags,
+// which it returns, and the go test flags and packages, each kept in their
+// order. Like with 'go test', everything after -args is for the test binary.
+func (f *buildFlagSet) splitTestArgs(args []string) (garbleArgs, buildFlags []string) {
+	garbleArgs = args[:1]
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-args" || arg == "--args" {
+			f.testFlags = append(f.testFlags, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			f.packageArgs = append(f.packageArgs, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
+		}
+		takesValue := goTestValueFlags[name]
+		list := &f.testFlags
+		if fl := f.flagSet.Lookup(name); fl != nil {
+			list, takesValue = &garbleArgs, fl.NoOptDefVal == ""
+		} else if goBuildFlagNames[name] {
+			list = &buildFlags
+		}
+		*list = append(*list, arg)
+		if !hasValue && takesValue && i+1 < len(args) {
+			i++
+			*list = append(*list, args[i])
+		}
+	}
+	return garbleArgs, buildFlags
+}
+
 // Set build flags in environment so that they will be available when the app is called by toolexec
 func (f *buildFlagSet) toEnv() error {
 
 	fmt.Println("ONLY: ", *f.only)
 
-	err := os.Setenv("ONLY", *f.only)
+	err := f.packagesToEnv()
 	if err != nil {
 		return err
 	}
@@ -69,25 +240,45 @@ func (f *buildFlagSet) toEnv() error {
 		return err
 	}
 
-	includeStr := strings.Join(*f.include, ",")
-	err = os.Setenv("INCLUDE", includeStr)
+	var skipStrings string
+	if *f.skipStrings {
+		skipStrings = "TRUE"
+	} else {
+		skipStrings = "FALSE"
+	}
+	err = os.Setenv("SKIP_STRINGS", skipStrings)
+	if err != nil {
+		return err
+	}
+
+	err = os.Setenv("LITERALS", strings.Join(*f.literals, ","))
 	if err != nil {
 		return err
 	}
 
-	excludeStr := strings.Join(*f.exclude, ",")
-	err = os.Setenv("EXCLUDE", excludeStr)
+	obfuscateLines := "FALSE"
+	if *f.obfuscateLines {
+		obfuscateLines = "TRUE"
+	}
+	err = os.Setenv("OBFUSCATE_LINES", obfuscateLines)
 	if err != nil {
 		return err
 	}
 
-	var skipStrings string
-	if *f.skipStrings {
-		skipStrings = "TRUE"
-	} else {
-		skipStrings = "FALSE"
+	importPaths := "FALSE"
+	if *f.importPaths {
+		importPaths = "TRUE"
 	}
-	err = os.Setenv("SKIP_STRINGS", skipStrings)
+	err = os.Setenv("OBFUSCATE_IMPORT_PATHS", importPaths)
+	if err != nil {
+		return err
+	}
+
+	controlFlow := "FALSE"
+	if *f.controlFlow {
+		controlFlow = "TRUE"
+	}
+	err = os.Setenv("CONTROL_FLOW", controlFlow)
 	if err != nil {
 		return err
 	}
@@ -95,30 +286,124 @@ func (f *buildFlagSet) toEnv() error {
 	return nil
 }
 
+// packagesToEnv sets the package patterns in the environment, with the
+// relative ones turned into import paths. 'garble list' needs just these.
+func (f *buildFlagSet) packagesToEnv() error {
+	var only []string
+	if *f.only != "" {
+		only = []string{*f.only}
+	}
+	for name, patterns := range map[string][]string{"ONLY": only, "INCLUDE": *f.include, "EXCLUDE": *f.exclude} {
+		resolved, err := resolvePatterns(patterns)
+		if err != nil {
+			return err
+		}
+		// one per line, as regular expressions may have commas
+		err = os.Setenv(name, strings.Join(resolved, "\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	overrides := ""
+	if len(f.overrides) > 0 {
+		resolved := make([]packageOverride, len(f.overrides))
+		for i, o := range f.overrides {
+			var err error
+			if o.Packages, err = resolvePatterns(o.Packages); err != nil {
+				return err
+			}
+			resolved[i] = o
+		}
+		data, err := json.Marshal(resolved)
+		if err != nil {
+			return err
+		}
+		overrides = string(data)
+	}
+	return os.Setenv("PACKAGE_OVERRIDES", overrides)
+}
+
 func newBuildFlagSet() *buildFlagSet {
 	fSet := flag.NewFlagSet("garble", flag.ExitOnError)
 
 	flagSet := buildFlagSet{flagSet: fSet}
 
-	flagSet.goBuildFlags = fSet.String("go-build-flags", "", "A string of flags " +
+	flagSet.goBuildFlags = fSet.String("go-build-flags", "", "A string of flags "+
 		"(wrapped in single quotes) to be passed to the 'go build' command.")
 
-	flagSet.only = fSet.String("only", "", "Accepts a package name. " +
-		"Only the package and it's subpackages will be garbled. ")
+	flagSet.only = fSet.String("only", "", "Accepts a package pattern. "+
+		"Only the matching packages will be garbled; use a pattern like foo.com/bar/... for a package and its subpackages.")
 
 	flagSet.include = new([]string)
-	fSet.StringArrayVar(flagSet.include, "include", []string{}, "Use with top level packages that don't have a . in the import name." +
+	fSet.StringArrayVar(flagSet.include, "include", []string{}, "Accepts a package pattern. Use with top level packages that don't have a . in the import name."+
 		" For example, if a go.mod module is named myPackage instead of github.com/me/myPackage, it would not be garbled by default.")
 
 	flagSet.exclude = new([]string)
-	fSet.StringArrayVar(flagSet.exclude, "exclude", []string{}, "Accepts a package name. The package will not be garbled. " +
+	fSet.StringArrayVar(flagSet.exclude, "exclude", []string{}, "Accepts a package pattern. The matching packages will not be garbled. "+
 		"May be used multiple times to exclude multiple packages.")
 
 	flagSet.codeOutDir = fSet.String("code-out-dir", "", "Directory to output garbled code for inspection.")
 
-	flagSet.skipStrings = fSet.Bool("skip-strings", false, "set this flag if you don't want to obfuscate strings.")
+	flagSet.skipStrings = fSet.Bool("skip-strings", false, "set this flag if you don't want to obfuscate strings, "+
+		"or integer, float, boolean and []byte literals.")
 	fSet.Lookup("skip-strings").NoOptDefVal = "true" // if they don't pass a value but they pass the flag, set to true
 
+	flagSet.literals = new([]string)
+	fSet.StringSliceVar(flagSet.literals, "literals", []string{}, "A comma-separated list of the string obfuscators to pick from "+
+		"at random for each literal. Defaults to all of them: "+strings.Join(stringsG.ObfuscatorNames(), ", ")+".")
+
+	flagSet.obfuscateLines = fSet.Bool("obfuscate-lines", false, "set this flag to shuffle and randomize line numbers. "+
+		"The symbol map records the original lines, so that 'garble ungarble' can restore them.")
+	fSet.Lookup("obfuscate-lines").NoOptDefVal = "true"
+
+	flagSet.importPaths = fSet.Bool("import-paths", false, "set this flag to also hash the import paths of garbled packages, "+
+		"which otherwise show up in stack traces and symbol names. The module info embedded in the binary is dropped too.")
+	fSet.Lookup("import-paths").NoOptDefVal = "true"
+
+	flagSet.controlFlow = fSet.Bool("control-flow", false, "set this flag to flatten the control flow of functions "+
+		"into a loop over a switch. A //garble:nocontrolflow comment on a function, or above the package clause, opts out.")
+	fSet.Lookup("control-flow").NoOptDefVal = "true"
+
+	flagSet.exportedMethods = fSet.Bool("exported-methods", false, "set this flag to also garble exported methods, "+
+		"unless an interface anywhere in the build, including the standard library, has a method with the same name, "+
+		"or their type may reach reflection, like text/template, by being converted to an interface.")
+	fSet.Lookup("exported-methods").NoOptDefVal = "true"
+
+	flagSet.exportedFields = fSet.Bool("exported-fields", false, "set this flag to also garble exported struct fields, "+
+		"except on types which have struct tags or may reach reflection, like encoding/json, by being converted to an interface.")
+	fSet.Lookup("exported-fields").NoOptDefVal = "true"
+
+	flagSet.reportPath = fSet.String("report", "", "Where to write a report of which types kept their exported "+
+		"field and method names, and why. Used with the exported-fields and exported-methods flags.")
+
+	flagSet.mapPath = fSet.String("map-path", "", "Where to write the symbol map, which lets "+
+		"'garble ungarble' restore the original names without access to the source. It's only written if given, "+
+		"as anyone with it can undo the obfuscation.")
+
+	flagSet.seed = fSet.String("seed", "", "Derive the salt from this value instead of generating a random one, "+
+		"so that builds are reproducible. salt.txt isn't written; pass the same seed to 'garble ungarble'.")
+
+	flagSet.seedFromGit = fSet.Bool("seed-from-git", false, "set this flag to derive the salt from the current "+
+		"git commit and the go.mod file, like the seed flag.")
+	fSet.Lookup("seed-from-git").NoOptDefVal = "true"
+
+	flagSet.writeSalt = fSet.Bool("write-salt", false, "set this flag to write the salt to salt.txt in plain text. "+
+		"Anyone with the salt and the source can undo the obfuscation.")
+	fSet.Lookup("write-salt").NoOptDefVal = "true"
+
+	flagSet.bundlePath = fSet.String("bundle-path", "garble.bundle", "Where to write the encrypted salt and symbol map, "+
+		"when bundle-passphrase or bundle-recipient is used.")
+
+	flagSet.bundlePassphrase = fSet.String("bundle-passphrase", "", "Encrypt the salt and symbol map with this passphrase. "+
+		"Defaults to $GARBLE_BUNDLE_PASSPHRASE.")
+
+	flagSet.bundleRecipient = fSet.String("bundle-recipient", "", "Encrypt the salt and symbol map for this age "+
+		"X25519 public key, like age1..., as made by age-keygen.")
+
+	flagSet.configPath = fSet.String("config", "", "Path to a garble.toml or garble.yaml file with the settings for the build. "+
+		"Defaults to the one at the root of the main module, if any. Flags given on the command line win over the file.")
+
 	fSet.Usage = func() {
 		fmt.Fprintf(os.Stderr, `
 Usage of garble build:
@@ -127,13 +412,24 @@ Usage of garble build:
 
 Which is equivalent to the longer:
 
-	go build -a -trimpath -toolexec=garble [build flags] [package]
+	go build -trimpath -toolexec=garble [build flags] [package]
+
+The same flags work with 'garble test [packages] [flags] [go test flags]'
+and 'garble run [package] [flags] [-- program args]', which ungarble the
+failures and panics in the output.
 
 The [build flags] referred to above are garble specific flags. To pass
 flags to the 'go build' command, use the flag 'go-build-flags'
 
 All packages except for standard library packages are garbled by default.
 
+The only, include and exclude flags take package patterns like the ones for
+'go list': foo.com/bar is just that package, foo.com/bar/... is it and all
+the packages below it, and ./... is relative to the current directory. A
+pattern starting with re: is a regular expression, and one starting with !
+takes back what the patterns before it matched. Run 'garble list' to see
+which packages a build would garble, and why.
+
 Standard library code is never garbled.
 
 `[1:])
@@ -146,14 +442,21 @@ Standard library code is never garbled.
 }
 
 type ungarbleFlagSet struct {
-	sourcePath *string
-	salt *string
-	logPath *string
-	outputPath *string
-	flagSet *flag.FlagSet
+	sourcePath       *string
+	salt             *string
+	mapPath          *string
+	logPath          *string
+	outputPath       *string
+	allNames         *bool
+	seed             *string
+	seedFromGit      *bool
+	bundlePath       *string
+	bundlePassphrase *string
+	bundleIdentity   *string
+	flagSet          *flag.FlagSet
 }
 
-func(f *ungarbleFlagSet) fSet() *flag.FlagSet {
+func (f *ungarbleFlagSet) fSet() *flag.FlagSet {
 	return f.flagSet
 }
 
@@ -164,41 +467,59 @@ func (f *ungarbleFlagSet) parse() error {
 		return err
 	}
 
-	if *f.salt == "" {
-		return errors.New("Salt flag must be set")
+	if *f.mapPath == "" && *f.bundlePath == "" && (*f.salt == "" && *f.seed == "" && !*f.seedFromGit || *f.sourcePath == "") {
+		return errors.New("Either the map path flag, the bundle path flag, or both the source path flag and one " +
+			"of the salt, seed or seed-from-git flags must be set")
+	}
 
+	if *f.bundlePassphrase == "" {
+		*f.bundlePassphrase = os.Getenv("GARBLE_BUNDLE_PASSPHRASE")
+	}
+	if *f.bundlePath != "" && *f.bundlePassphrase == "" && *f.bundleIdentity == "" {
+		return errors.New("The bundle path flag needs either the bundle passphrase or bundle identity flag")
 	}
 
 	if *f.logPath == "" {
 		return errors.New("Log path flag must be set")
 
-	} else {
+	} else if *f.logPath != ungarble.StdStream {
 		*f.logPath, err = filepath.Abs(*f.logPath)
 		if err != nil {
-			return fmt.Errorf("Problem getting absolute path of log path: ", err)
+			return fmt.Errorf("Problem getting absolute path of log path: %v", err)
 		}
 
 	}
 
-	if *f.outputPath == "" {
+	if *f.outputPath == "" && *f.logPath == ungarble.StdStream {
+		// reading from stdin, so act as a filter
+		*f.outputPath = ungarble.StdStream
+
+	} else if *f.outputPath == "" {
 		// if not supplied, use working dir
 		wd, err := os.Getwd()
 		if err != nil {
-			return fmt.Errorf("Output flag was not passed, and couldn't determine working directory: ", err)
+			return fmt.Errorf("Output flag was not passed, and couldn't determine working directory: %v", err)
 		}
 
 		outputPath := filepath.Join(wd, "ungarbled_log.txt")
 
 		*f.outputPath = outputPath
 
-	} else {
-		*f.outputPath, err = filepath.Abs(*f.sourcePath)
+	} else if *f.outputPath != ungarble.StdStream {
+		*f.outputPath, err = filepath.Abs(*f.outputPath)
 		if err != nil {
 			return errors.Wrap(err, "Could not create absolute path from output path flag")
 		}
 	}
 
-	if *f.sourcePath !=  ""{
+	if *f.mapPath != "" {
+		*f.mapPath, err = filepath.Abs(*f.mapPath)
+		if err != nil {
+			return errors.Wrap(err, "Could not create absolute path for map path flag")
+		}
+	}
+
+	if *f.sourcePath != "" {
 		*f.sourcePath, err = filepath.Abs(*f.sourcePath)
 		if err != nil {
 			return errors.Wrap(err, "Could not create absolute path for source path flag")
@@ -214,12 +535,33 @@ func newUngarbleFlagSet() *ungarbleFlagSet {
 	flagSet := ungarbleFlagSet{flagSet: fSet}
 
 	flagSet.sourcePath = fSet.String("source-path", "", "path to the original source that will be used for ungarbling.")
-	flagSet.salt = fSet.String("salt", "", "the salt used for hashing, that was output to salt.txt," +
+	flagSet.salt = fSet.String("salt", "", "the salt used for hashing, that was output to salt.txt,"+
 		" when you originally garbled the code.")
-	flagSet.logPath = fSet.String("log-path", "", "path to the log file.")
+	flagSet.mapPath = fSet.String("map-path", "", "path to the symbol map written by 'garble build'."+
+		" Can be used instead of source-path and salt.")
+	flagSet.logPath = fSet.String("log-path", "", "path to the log file. Use '-' to read from stdin.")
+
+	flagSet.outputPath = fSet.String("output-path", "", "path where you want the ungarbled log to be written"+
+		" Defaults to the current working directory, or to stdout when reading from stdin. Use '-' for stdout.")
+
+	flagSet.allNames = fSet.Bool("all-names", false, "replace every hashed type, const, var, field and func name"+
+		" found anywhere in the log, not just those in stack traces. Ambiguous names list all candidates, like {foo|bar}.")
+	fSet.Lookup("all-names").NoOptDefVal = "true"
 
-	flagSet.outputPath = fSet.String("output-path", "", "path where you want the ungarbled log to be written" +
-		" Defaults to the current working directory")
+	flagSet.seed = fSet.String("seed", "", "the seed the binary was built with, instead of the salt.")
+
+	flagSet.seedFromGit = fSet.Bool("seed-from-git", false, "set this flag if the binary was built with "+
+		"seed-from-git. The source path must be checked out at the same commit.")
+	fSet.Lookup("seed-from-git").NoOptDefVal = "true"
+
+	flagSet.bundlePath = fSet.String("bundle-path", "", "Path to an encrypted bundle written by 'garble build', "+
+		"which holds the salt and the symbol map.")
+
+	flagSet.bundlePassphrase = fSet.String("bundle-passphrase", "", "The passphrase the bundle was encrypted with. "+
+		"Defaults to $GARBLE_BUNDLE_PASSPHRASE.")
+
+	flagSet.bundleIdentity = fSet.String("bundle-identity", "", "Path to an age identity file, as made by age-keygen, "+
+		"with the private key matching the bundle's recipient.")
 
 	fSet.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\ngarble ungarble [ungarble flags]\n\n")
@@ -229,7 +571,3 @@ func newUngarbleFlagSet() *ungarbleFlagSet {
 
 	return &flagSet
 }
-
-
-
-
@@ -1,11 +1,20 @@
 module mvdan.cc/garble
 
-go 1.14
+go 1.23
 
 require (
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v0.3.0
 	github.com/dchest/uniuri v0.0.0-20200228104902-7aecb25e1fe5
 	github.com/pkg/errors v0.9.1
-	github.com/rogpeppe/go-internal v1.5.2
+	github.com/rogpeppe/go-internal v1.14.1
 	github.com/spf13/pflag v1.0.5
-	golang.org/x/tools v0.0.0-20200330040139-fa3cc9eebcfe
+	golang.org/x/tools v0.26.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/mod v0.21.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
 )
@@ -3,12 +3,17 @@ package hashing
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"go/ast"
 	"go/token"
 	"io"
+	"strings"
 )
 
-var b64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_z")
+// b64 encodes with the characters allowed in identifiers. There are only 63 of
+// those, and base64 rejects an alphabet with duplicates, so '-' stands in for
+// a second 'z' until HashWith replaces it.
+var b64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-")
 
 // The hashed filename is a combination of the package name and file name
 // eg sha256(pkgName + filename)
@@ -19,11 +24,11 @@ func HashFileName(salt string, originalName string, file *ast.File) string {
 }
 
 func getPackageName(node ast.Node) string {
-    switch x := node.(type) {
-    case *ast.File:
-        return x.Name.String()
-    }
-    return ""
+	switch x := node.(type) {
+	case *ast.File:
+		return x.Name.String()
+	}
+	return ""
 }
 
 func HashWith(salt, value string) string {
@@ -32,10 +37,26 @@ func HashWith(salt, value string) string {
 	d := sha256.New()
 	io.WriteString(d, salt)
 	io.WriteString(d, value)
-	sum := b64.EncodeToString(d.Sum(nil))
+	sum := strings.Replace(b64.EncodeToString(d.Sum(nil)), "-", "z", -1)
 
 	if token.IsExported(value) {
 		return "Z" + sum[:length]
 	}
 	return "z" + sum[:length]
-}
\ No newline at end of file
+}
+
+// SeedWith returns a seed for math/rand derived from the salt and value, so
+// that random choices made while garbling are the same for the same salt.
+func SeedWith(salt, value string) int64 {
+	d := sha256.New()
+	io.WriteString(d, salt)
+	io.WriteString(d, value)
+	return int64(binary.BigEndian.Uint64(d.Sum(nil)))
+}
+
+// SaltFromSeed derives a salt from a seed, so that builds with the same seed
+// hash every name the same way, without having to keep the salt around.
+func SaltFromSeed(seed string) string {
+	sum := sha256.Sum256([]byte("garble seed\n" + seed))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"mvdan.cc/garble/hashing"
+	"mvdan.cc/garble/symbolmap"
+)
+
+// obfuscateLines adds a //line directive before every top-level declaration
+// in the printed source of a garbled file. Each declaration starts at a random
+// line number, in a shuffled order, so that positions in stack traces say
+// nothing about the layout of the original source.
+//
+// The returned table maps the new line numbers back to the original ones. To
+// build it, the printed source is parsed again and walked in step with the
+// garbled file, whose positions still point at the original source.
+func obfuscateLines(src []byte, file *ast.File, name string) ([]byte, symbolmap.LineTable, error) {
+	table := symbolmap.LineTable{File: strings.TrimSuffix(name, ".go")}
+
+	printedFset := token.NewFileSet()
+	printed, err := parser.ParseFile(printedFset, name, src, parser.ParseComments)
+	if err != nil {
+		return nil, table, err
+	}
+
+	origNodes, printedNodes := lineNodes(file), lineNodes(printed)
+	if len(origNodes) != len(printedNodes) {
+		return nil, table, fmt.Errorf("could not obfuscate lines in %s: printed source doesn't match", name)
+	}
+
+	// origLines maps each printed line to the original line of the first
+	// node found on it.
+	origLines := make(map[int]int)
+	addLine := func(printedPos, origPos token.Pos) {
+		if !origPos.IsValid() {
+			return // added by garble, like the control flow dispatcher
+		}
+		line := printedFset.Position(printedPos).Line
+		if _, ok := origLines[line]; !ok {
+			origLines[line] = fset.Position(origPos).Line
+		}
+	}
+	for i, node := range printedNodes {
+		addLine(node.Pos(), origNodes[i].Pos())
+		if block, ok := node.(*ast.BlockStmt); ok {
+			// deferred calls run at the closing brace
+			addLine(block.Rbrace, origNodes[i].(*ast.BlockStmt).Rbrace)
+		}
+	}
+
+	// //go: directives must stay right before their declaration, so
+	// our //line directive goes above them.
+	directiveLines := make(map[int]bool)
+	for _, group := range printed.Comments {
+		for _, comment := range group.List {
+			if strings.HasPrefix(comment.Text, "//go:") {
+				directiveLines[printedFset.Position(comment.Pos()).Line] = true
+			}
+		}
+	}
+
+	lines := bytes.SplitAfter(src, []byte("\n"))
+
+	// Every declaration, apart from imports, is a block of lines.
+	var starts []int
+	for _, decl := range printed.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			continue
+		}
+		start := printedFset.Position(decl.Pos()).Line
+		for directiveLines[start-1] {
+			start--
+		}
+		if len(starts) > 0 && starts[len(starts)-1] >= start {
+			continue // on the same line as the previous declaration
+		}
+		starts = append(starts, start)
+	}
+
+	rnd := rand.New(rand.NewSource(hashing.SeedWith(getSalt(), name)))
+
+	// Shuffle the blocks, and give each one a starting line after the
+	// previous one with a random gap, so that they never overlap.
+	order := rnd.Perm(len(starts))
+	newStarts := make(map[int]int, len(starts))
+	next := 1 + rnd.Intn(1000)
+	for _, i := range order {
+		end := len(lines)
+		if i+1 < len(starts) {
+			end = starts[i+1] - 1
+		}
+		block := symbolmap.LineBlock{Start: next}
+		origLine := 0
+		for line := starts[i]; line <= end; line++ {
+			if l, ok := origLines[line]; ok {
+				origLine = l
+			} else if origLine > 0 {
+				// no node starts here; assume it follows the last one
+				origLine++
+			}
+			block.Lines = append(block.Lines, origLine)
+		}
+		table.Blocks = append(table.Blocks, block)
+		newStarts[starts[i]] = next
+		next += len(block.Lines) + 1 + rnd.Intn(1000)
+	}
+	sort.Slice(table.Blocks, func(i, j int) bool {
+		return table.Blocks[i].Start < table.Blocks[j].Start
+	})
+
+	var buf bytes.Buffer
+	for i, line := range lines {
+		if start, ok := newStarts[i+1]; ok {
+			fmt.Fprintf(&buf, "//line %s:%d\n", name, start)
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes(), table, nil
+}
+
+// lineNodes returns all the nodes in a file, in the order they're visited.
+// Comments are skipped, since the garbled file has dropped most of them.
+func lineNodes(file *ast.File) []ast.Node {
+	var nodes []ast.Node
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node.(type) {
+		case nil:
+			return false
+		case *ast.CommentGroup, *ast.Comment:
+			return false
+		}
+		nodes = append(nodes, node)
+		return true
+	})
+	return nodes
+}
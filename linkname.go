@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"mvdan.cc/garble/hashing"
+)
+
+// A //go:linkname directive ties a local name to the symbol of another
+// package, spelled out with its import path:
+//
+//	//go:linkname localName foo.com/bar.target
+//
+// When foo.com/bar is garbled, its compile hashes target like any other name,
+// so the directive is rewritten to the hashed name, and to the hashed import
+// path with --import-paths. Since each package is compiled on its own,
+// 'garble build' first finds the targets which their own package won't hash,
+// or which are linked to by packages that aren't garbled, and passes them on
+// via $KEEP_LINKNAMES_FILE, so that both sides keep them.
+
+// keptLinknames is loaded from $KEEP_LINKNAMES_FILE on first use.
+var keptLinknames map[string]bool
+
+type linkname struct {
+	local  string
+	target string // empty for the one-argument form
+}
+
+func parseLinkname(text string) (linkname, bool) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || fields[0] != "//go:linkname" {
+		return linkname{}, false
+	}
+	l := linkname{local: fields[1]}
+	if len(fields) > 2 {
+		l.target = fields[2]
+	}
+	return l, true
+}
+
+// splitLinknameTarget splits a target like foo.com/bar.name into the import
+// path and the name. Method targets, like foo.com/bar.T.method or
+// foo.com/bar.(*T).method, keep the receiver in the name; see linknameMethod.
+// Targets without a path aren't split.
+func splitLinknameTarget(target string) (path, name string, ok bool) {
+	slash := strings.LastIndex(target, "/")
+	dot := strings.Index(target[slash+1:], ".")
+	if dot < 0 {
+		return "", "", false
+	}
+	path, name = target[:slash+1+dot], target[slash+1+dot+1:]
+	if name == "" {
+		return "", "", false
+	}
+	if strings.Contains(name, ".") {
+		if _, _, ok := linknameMethod(name); !ok {
+			return "", "", false
+		}
+	}
+	return path, name, true
+}
+
+// linknameMethod splits the name of a method target, like T.method or
+// (*T).method, into the receiver type's name and the method's name.
+func linknameMethod(name string) (typeName, method string, ok bool) {
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return "", "", false
+	}
+	typeName, method = name[:dot], name[dot+1:]
+	if strings.HasPrefix(typeName, "(*") && strings.HasSuffix(typeName, ")") {
+		typeName = typeName[2 : len(typeName)-1]
+	}
+	if typeName == "" || method == "" || strings.ContainsAny(typeName, ".()*") {
+		return "", "", false
+	}
+	return typeName, method, true
+}
+
+// linknameKept returns whether a top-level name in a package must be kept, as
+// other packages link to it by that name.
+func linknameKept(pkgPath, name string) bool {
+	path := os.Getenv("KEEP_LINKNAMES_FILE")
+	if path == "" {
+		return false
+	}
+	if keptLinknames == nil {
+		keptLinknames = readNames(path)
+	}
+	return keptLinknames[pkgPath+"."+name]
+}
+
+// rewriteLinknames updates the //go:linkname directives in a package's files
+// to the names given by renameIdents, which must have run on all of them.
+func rewriteLinknames(files []*ast.File, info *types.Info) {
+	scope := buildInfo.pkg.Scope()
+	finalNames := make(map[types.Object]string)
+	for ident, obj := range info.Defs {
+		if obj != nil && obj.Parent() == scope {
+			finalNames[obj] = ident.Name
+		}
+	}
+	localName := func(name string) string {
+		if final, ok := finalNames[scope.Lookup(name)]; ok {
+			return final
+		}
+		return name
+	}
+	for _, file := range files {
+		for _, group := range file.Comments {
+			for _, comment := range group.List {
+				l, ok := parseLinkname(comment.Text)
+				if !ok {
+					continue
+				}
+				text := "//go:linkname " + localName(l.local)
+				if l.target != "" {
+					text += " " + linknameTarget(l.target, localName)
+				}
+				comment.Text = text
+			}
+		}
+	}
+}
+
+// linknameTarget returns the symbol a garbled package declares for a target.
+func linknameTarget(target string, localName func(string) string) string {
+	path, name, ok := splitLinknameTarget(target)
+	if !ok || isStandardLibrary(path) {
+		return target
+	}
+	_, _, method := linknameMethod(name)
+	switch {
+	case method:
+		// Methods and their types are kept by collectKeptLinknames.
+	case path == buildInfo.pkgPath:
+		name = localName(name)
+	case linknameKept(path, name):
+	default:
+		if buildInfo.imports[path].buildID != "" {
+			garbledPkg, err := garbledImport(path)
+			if err != nil {
+				panic(err) // shouldn't happen
+			}
+			if garbledPkg.Scope().Lookup(name) != nil {
+				break // not garbled, e.g. if it's assembly
+			}
+		}
+		name = hashing.HashWith(getSalt(), name)
+	}
+	if hashed, ok := garbledPackagePath(path); ok {
+		path = hashed
+	}
+	return path + "." + name
+}
+
+// linknamePackage is a package in the build, parsed to find out what its
+// //go:linkname directives need.
+type linknamePackage struct {
+	path       string // as in symbol names, so "main" for commands
+	garbled    bool
+	hasAsm     bool
+	files      []*ast.File
+	directives *sourceDirectives
+}
+
+// collectKeptLinknames returns the names, as path.name, which must not be
+// hashed because of //go:linkname directives in the non-std packages of a
+// build. Those are:
+//
+//   - the names marked with the one-argument form, //go:linkname name, which
+//     lets other packages link to them;
+//   - the targets in packages that won't hash them, such as when they're
+//     ignored, or declared in assembly;
+//   - the targets of packages which aren't garbled, as those can't be
+//     rewritten;
+//   - the targets a func body is pushed into, as their package just declares
+//     them without a body, and can't tell where it comes from.
+func collectKeptLinknames(pkgs []listedPackage) map[string]bool {
+	byPath := make(map[string]listedPackage)
+	for _, pkg := range pkgs {
+		byPath[linknamePath(pkg)] = pkg
+	}
+	parsed := make(map[string]*linknamePackage)
+	parse := func(pkg listedPackage) *linknamePackage {
+		path := linknamePath(pkg)
+		if p, ok := parsed[path]; ok {
+			return p
+		}
+		p := &linknamePackage{path: path, hasAsm: len(pkg.SFiles) > 0}
+		fset := token.NewFileSet()
+		for _, name := range pkg.files() {
+			file, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+			if err != nil {
+				// The compiler will report the error; we needn't do it twice.
+				continue
+			}
+			p.files = append(p.files, file)
+		}
+		p.garbled = pkg.garbled(p.files)
+		p.directives = collectDirectives(p.files)
+		parsed[path] = p
+		return p
+	}
+
+	kept := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if pkg.Standard || !hasLinkname(pkg) {
+			continue
+		}
+		p := parse(pkg)
+		for _, file := range p.files {
+			for _, group := range file.Comments {
+				for _, comment := range group.List {
+					l, ok := parseLinkname(comment.Text)
+					if !ok {
+						continue
+					}
+					if l.target == "" {
+						kept[p.path+"."+l.local] = true
+						continue
+					}
+					path, name, ok := splitLinknameTarget(l.target)
+					if !ok {
+						continue
+					}
+					target, ok := byPath[path]
+					typeName, method, isMethod := linknameMethod(name)
+					switch {
+					case !ok, target.Standard:
+						// Not in the build, or never garbled.
+					case isMethod:
+						// The symbol spells out both the type and the
+						// method, so neither may be hashed.
+						kept[path+"."+typeName] = true
+						kept[path+"."+typeName+"."+method] = true
+					case !p.garbled, p.pushes(l.local), !parse(target).hashes(name):
+						kept[path+"."+name] = true
+					}
+				}
+			}
+		}
+	}
+	return kept
+}
+
+// linknamePath returns the import path of a package as used in its symbols.
+func linknamePath(pkg listedPackage) string {
+	if pkg.Name == "main" {
+		return "main"
+	}
+	// Drop the suffix of test variants, like "foo [foo.test]".
+	if i := strings.Index(pkg.ImportPath, " ["); i >= 0 {
+		return pkg.ImportPath[:i]
+	}
+	return pkg.ImportPath
+}
+
+// hasLinkname returns whether any of a package's Go files might have a
+// //go:linkname directive, so that most packages needn't be parsed.
+func hasLinkname(pkg listedPackage) bool {
+	for _, name := range pkg.files() {
+		src, err := ioutil.ReadFile(name)
+		if err == nil && bytes.Contains(src, []byte("//go:linkname")) {
+			return true
+		}
+	}
+	return false
+}
+
+// pushes returns whether a local name in a //go:linkname is a func with a
+// body, which then provides the body of the target.
+func (p *linknamePackage) pushes(local string) bool {
+	decl := p.funcDecl(local)
+	return decl != nil && decl.Body != nil
+}
+
+// hashes returns whether a package's compile hashes a top-level name, like
+// renameIdents decides.
+func (p *linknamePackage) hashes(name string) bool {
+	if !p.garbled {
+		return false
+	}
+	if decl := p.funcDecl(name); decl != nil {
+		if keepsName(funcDeclName(decl), p.directives, p.path) {
+			return false
+		}
+		// Funcs without a body are only hashed when there's assembly or
+		// a //go:linkname which we know about.
+		return decl.Body != nil || p.hasAsm || linknamedNames(p.files)[name]
+	}
+	for _, file := range p.files {
+		for _, decl := range file.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				spec := spec.(*ast.ValueSpec)
+				for _, ident := range spec.Names {
+					if ident.Name == name {
+						return !keepsName(declaredName{name: name, pos: ident.Pos(), topLevel: true}, p.directives, p.path)
+					}
+				}
+			}
+		}
+	}
+	return false // not declared in Go, such as in assembly
+}
+
+func (p *linknamePackage) funcDecl(name string) *ast.FuncDecl {
+	for _, file := range p.files {
+		for _, decl := range file.Decls {
+			if decl, ok := decl.(*ast.FuncDecl); ok && decl.Recv == nil && decl.Name.Name == name {
+				return decl
+			}
+		}
+	}
+	return nil
+}
+
+// linknamedNames returns the local names in //go:linkname directives.
+func linknamedNames(files []*ast.File) map[string]bool {
+	names := make(map[string]bool)
+	for _, file := range files {
+		for _, group := range file.Comments {
+			for _, comment := range group.List {
+				if l, ok := parseLinkname(comment.Text); ok {
+					names[l.local] = true
+				}
+			}
+		}
+	}
+	return names
+}
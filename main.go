@@ -4,29 +4,34 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/dchest/uniuri"
 	"go/ast"
 	"go/importer"
 	"go/parser"
 	"go/printer"
 	"go/token"
 	"go/types"
-	"golang.org/x/tools/go/ast/astutil"
 	"io"
 	"io/ioutil"
 	"log"
-	"mvdan.cc/garble/hashing"
-	stringsG "mvdan.cc/garble/strings"
-	"mvdan.cc/garble/ungarble"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+
+	"github.com/dchest/uniuri"
+	"golang.org/x/tools/go/ast/astutil"
+
+	"mvdan.cc/garble/bundle"
+	"mvdan.cc/garble/hashing"
+	stringsG "mvdan.cc/garble/strings"
+	"mvdan.cc/garble/symbolmap"
+	"mvdan.cc/garble/ungarble"
 )
 
 func main() { os.Exit(main1()) }
@@ -42,6 +47,14 @@ var (
 	garbledImporter = importer.ForCompiler(fset, "gc", func(path string) (io.ReadCloser, error) {
 		return os.Open(buildInfo.imports[path].packagefile)
 	}).(types.ImporterFrom)
+
+	// symbols collects the names hashed while compiling a package, to be
+	// written to the map file.
+	symbols = make(map[symbolmap.Entry]bool)
+
+	// lineTables collects the line tables of the files in a package, when
+	// line numbers are obfuscated.
+	lineTables []symbolmap.LineTable
 )
 
 // origLookup helps implement a types.Importer which finds the export data for
@@ -90,6 +103,23 @@ func garbledImport(path string) (*types.Package, error) {
 
 type packageInfo struct {
 	buildID string
+	pkgPath string
+	pkg     *types.Package
+
+	// noControlFlow is set by a //garble:nocontrolflow directive above
+	// the package clause of any of the files.
+	noControlFlow bool
+
+	// directives holds what the //garble: directives in the source ask
+	// for.
+	directives *sourceDirectives
+
+	// hasAsm is set when the package has assembly files, which transformAsm
+	// renames the funcs without a body in. Those named by a //go:linkname,
+	// in linknamed, are renamed too, as rewriteLinknames follows them.
+	hasAsm    bool
+	linknamed map[string]bool
+
 	imports map[string]importedPkg
 }
 
@@ -100,10 +130,31 @@ type importedPkg struct {
 	pkg *types.Package
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, `
+Usage of garble:
+
+	garble build [package] [flags]
+	garble test [packages] [flags] [go test flags]
+	garble run [package] [flags] [-- program args]
+	garble ungarble [ungarble flags]
+	garble config print [build flags]
+	garble list [build flags]
+
+'garble build' is equivalent to the longer:
+
+	go build -trimpath -toolexec=garble [build flags] [package]
+
+Use 'garble build -h' or 'garble ungarble -h' for the flags.
+`)
+}
+
 func main1() int {
+	flag.Usage = usage
 
 	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "Must be run with 'build' or 'ungarble' subcommand")
+		fmt.Fprintln(os.Stderr, "Must be run with the 'build', 'test', 'run', 'config', 'list' or 'ungarble' subcommand")
+		flag.Usage()
 		return 2
 	}
 
@@ -119,7 +170,35 @@ func main1() int {
 			return 2
 		}
 
-	case "build":
+	case "config":
+		if len(os.Args) < 3 || os.Args[2] != "print" {
+			fmt.Fprintln(os.Stderr, "Usage: garble config print [build flags]")
+			return 2
+		}
+		buildFSet := newBuildFlagSet()
+		if err := buildFSet.parseArgs(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if err := buildFSet.printConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+
+	case "list":
+		buildFSet := newBuildFlagSet()
+		if err := buildFSet.parseArgs(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if err := buildFSet.printPackageList(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+
+	case "build", "test", "run":
 		fSet = newBuildFlagSet()
 		// also sets flags in environment
 		err := fSet.parse()
@@ -128,6 +207,17 @@ func main1() int {
 			fSet.fSet().Usage()
 			return 2
 		}
+
+	default:
+		// Either -toolexec is running us, or it's a mistake like 'garble -h'.
+		flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+		if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+			return 2 // the error and usage are already printed
+		}
+		if flag.NArg() == 0 {
+			flag.Usage()
+			return 2
+		}
 	}
 
 	if err := mainErr(fSet); err != nil {
@@ -145,18 +235,61 @@ func mainErr(flagSet customFlagSet) error {
 
 		ungarbleFSet := flagSet.(*ungarbleFlagSet)
 
-		if *ungarbleFSet.logPath == "" || *ungarbleFSet.sourcePath == "" || *ungarbleFSet.salt == "" {
-			return errors.New("Missing required arguments. 'log-file', 'source-path', and 'salt' are all required")
+		if *ungarbleFSet.logPath == "" {
+			return errors.New("Missing required argument 'log-path'")
 		}
 
-		err := ungarble.Ungarble(*ungarbleFSet.logPath, *ungarbleFSet.sourcePath, *ungarbleFSet.salt, *ungarbleFSet.outputPath)
+		salt := *ungarbleFSet.salt
+		var symbolMap *symbolmap.Map
+		if *ungarbleFSet.bundlePath != "" {
+			var identities []byte
+			if *ungarbleFSet.bundleIdentity != "" {
+				var err error
+				if identities, err = ioutil.ReadFile(*ungarbleFSet.bundleIdentity); err != nil {
+					return err
+				}
+			}
+			b, err := bundle.Read(*ungarbleFSet.bundlePath, *ungarbleFSet.bundlePassphrase, string(identities))
+			if err != nil {
+				return err
+			}
+			if salt == "" {
+				salt = b.Salt
+			}
+			symbolMap = b.Map
+		}
+		seedDir := *ungarbleFSet.sourcePath
+		if seedDir == "" {
+			seedDir = "."
+		}
+		seedSalt, err := saltFromSeed(*ungarbleFSet.seed, *ungarbleFSet.seedFromGit, seedDir)
+		if err != nil {
+			return err
+		}
+		if seedSalt != "" {
+			salt = seedSalt
+		}
+
+		if *ungarbleFSet.mapPath == "" && symbolMap == nil && (*ungarbleFSet.sourcePath == "" || salt == "") {
+			return errors.New("Missing required arguments. Either 'map-path', 'bundle-path', or both 'source-path' and one of 'salt', 'seed' or 'seed-from-git' are required")
+		}
+
+		err = ungarble.Ungarble(ungarble.Options{
+			LogPath:    *ungarbleFSet.logPath,
+			SourcePath: *ungarbleFSet.sourcePath,
+			Salt:       salt,
+			MapPath:    *ungarbleFSet.mapPath,
+			Map:        symbolMap,
+			OutputPath: *ungarbleFSet.outputPath,
+			AllNames:   *ungarbleFSet.allNames,
+		})
 		if err != nil {
 			return err
 		}
 
 		return nil
 
-	case "build", "test":
+	case "build", "test", "run":
 
 		buildFSet := flagSet.(*buildFlagSet)
 
@@ -165,8 +298,13 @@ func mainErr(flagSet customFlagSet) error {
 			return errors.New("You must supply a path to the code to be garbled")
 		}
 
+		seedSalt, err := saltFromSeed(*buildFSet.seed, *buildFSet.seedFromGit, ".")
+		if err != nil {
+			return err
+		}
+
 		// generate salt for hashing, set as env var, and write to file
-		if err := setSalt(); err != nil {
+		if err := setSalt(seedSalt, *buildFSet.writeSalt); err != nil {
 			log.Println(err)
 			return err
 		}
@@ -182,24 +320,139 @@ func mainErr(flagSet customFlagSet) error {
 		}
 		goArgs := []string{
 			cmd,
-			"-a",
 			"-trimpath",
 			"-toolexec=" + execPath,
 		}
+		// 'garble run' builds the binary like 'garble build' does, so
+		// that its output can be ungarbled with the names from it.
+		var runPath string
+		if cmd == "run" {
+			tempDir, err := ioutil.TempDir("", "garble-run-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tempDir)
+			runPath = filepath.Join(tempDir, runBinaryName(buildFSet.packages()))
+			goArgs = []string{"build", "-trimpath", "-toolexec=" + execPath, "-o", runPath}
+		}
+		if *buildFSet.codeOutDir != "" {
+			// cached packages aren't compiled, so they wouldn't
+			// show up in the output directory
+			goArgs = append(goArgs, "-a")
+		}
 		if cmd == "test" {
 			// vet is generally not useful on garbled code; keep it
 			// disabled by default.
 			goArgs = append(goArgs, "-vet=off")
 		}
 
-		userSuppliedGoFlags := strings.Split(strings.Trim(*buildFSet.goBuildFlags, " "), " ")
+		userSuppliedGoFlags := buildFSet.goFlags
 
 		goArgs = append(goArgs, userSuppliedGoFlags...)
 
-		cmd := exec.Command("go", goArgs...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
+		// the packages to build come after the subcommand
+		packages := buildFSet.packages()
+		goArgs = append(goArgs, packages...)
+		goArgs = append(goArgs, buildFSet.testFlags...)
+
+		// The linkname analysis always runs, while the methods and fields
+		// are only analyzed when they may be garbled.
+		analyzeTypes := *buildFSet.exportedMethods || *buildFSet.exportedFields
+		pkgs, err := listPackages(userSuppliedGoFlags, packages, cmd == "test", analyzeTypes)
+		if err != nil {
+			return err
+		}
+		keptPath, err := writeNames(collectKeptLinknames(pkgs), "garble-linknames-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(keptPath)
+		os.Setenv("KEEP_LINKNAMES_FILE", keptPath)
+		asmPath, err := writeNames(asmGoFiles(pkgs), "garble-asm-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(asmPath)
+		os.Setenv("ASM_GO_FILES_FILE", asmPath)
+		if analyzeTypes {
+			// The types which may reach reflection keep both their
+			// fields and their exported methods.
+			fields, methods, report, err := collectKeptFields(pkgs)
+			if err != nil {
+				return err
+			}
+			if *buildFSet.reportPath != "" {
+				if err := ioutil.WriteFile(*buildFSet.reportPath, report, 0644); err != nil {
+					return err
+				}
+			}
+			if *buildFSet.exportedMethods {
+				for name := range collectKeptMethods(pkgs) {
+					methods[name] = true
+				}
+				keptPath, err := writeNames(methods, "garble-methods-")
+				if err != nil {
+					return err
+				}
+				defer os.Remove(keptPath)
+				os.Setenv("KEEP_METHODS_FILE", keptPath)
+			}
+			if *buildFSet.exportedFields {
+				keptPath, err := writeNames(fields, "garble-fields-")
+				if err != nil {
+					return err
+				}
+				defer os.Remove(keptPath)
+				os.Setenv("KEEP_FIELDS_FILE", keptPath)
+			}
+		}
+
+		// each compiled package writes the names it hashed in here
+		mapDir, err := mapCacheDir()
+		if err != nil {
+			return err
+		}
+		os.Setenv("GARBLE_MAP_DIR", mapDir)
+
+		goCmd := exec.Command("go", goArgs...)
+		goCmd.Stdout = os.Stdout
+		goCmd.Stderr = os.Stderr
+		// The output of the tests is held back until they're done, so
+		// that the failures and panics in it can be ungarbled with the
+		// names from the build.
+		var testOutput bytes.Buffer
+		if cmd == "test" {
+			goCmd.Stdout = &testOutput
+		}
+		goErr := goCmd.Run()
+		if goErr != nil && testOutput.Len() == 0 {
+			return goErr
+		}
+
+		symbolMap, err := builtSymbolMap(mapDir, userSuppliedGoFlags, packages, cmd == "test")
+		if err != nil {
+			if goErr != nil {
+				// most likely a build failure, with nothing to ungarble
+				testOutput.WriteTo(os.Stdout)
+				return goErr
+			}
+			return err
+		}
+		if cmd == "test" {
+			if err := ungarble.Filter(&testOutput, os.Stdout, symbolMap); err != nil {
+				return err
+			}
+		}
+		if err := writeSymbolMap(symbolMap, buildFSet); err != nil {
+			return err
+		}
+		if goErr != nil {
+			return goErr
+		}
+		if cmd == "run" {
+			return runBinary(runPath, buildFSet.programArgs(), symbolMap)
+		}
+		return nil
 	}
 
 	flag.Parse()
@@ -212,6 +465,72 @@ func mainErr(flagSet customFlagSet) error {
 	return runTransformations()
 }
 
+// builtSymbolMap merges the symbol map fragments of the packages in a build.
+func builtSymbolMap(mapDir string, goFlags, packages []string, test bool) (*symbolmap.Map, error) {
+	ids, err := builtActionIDs(goFlags, packages, test)
+	if err != nil {
+		return nil, err
+	}
+	return symbolmap.MergeFragments(mapDir, getSalt(), ids)
+}
+
+// runBinaryName returns the name for the binary built by 'garble run', after
+// the package, like 'go run' does.
+func runBinaryName(packages []string) string {
+	name := "main"
+	if len(packages) == 1 {
+		if abs, err := filepath.Abs(packages[0]); err == nil {
+			name = strings.TrimSuffix(filepath.Base(abs), ".go")
+		}
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// runBinary runs a binary built by 'garble run', with its stderr going
+// through the ungarbler as it's written, so that panics can be read straight
+// away.
+func runBinary(path string, args []string, symbolMap *symbolmap.Map) error {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	filterErr := ungarble.Filter(stderr, os.Stderr, symbolMap)
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return filterErr
+}
+
+// writeSymbolMap writes the map merged from the fragments written by each
+// compiled package, which 'garble ungarble' can use instead of the source.
+// When a bundle is encrypted, the map only goes in there, unless a map path
+// was given, by flag or in the config file.
+func writeSymbolMap(symbolMap *symbolmap.Map, f *buildFlagSet) error {
+	// Like the salt, the plain map undoes the obfuscation, so it's only
+	// written when asked for.
+	if mapPath := *f.mapPath; mapPath != "" {
+		log.Println("Writing symbol map to", mapPath+". It can be used to ungarble stacktraces without the source.")
+		if err := symbolMap.Write(mapPath); err != nil {
+			return err
+		}
+	}
+	if *f.bundlePassphrase == "" && *f.bundleRecipient == "" {
+		return nil
+	}
+	log.Println("Writing the encrypted salt and symbol map to", *f.bundlePath+".")
+	b := &bundle.Bundle{Salt: getSalt(), Map: symbolMap}
+	return b.Write(*f.bundlePath, *f.bundlePassphrase, *f.bundleRecipient)
+}
+
 // app has been called by toolexec binary, now we are applying the code transformations
 func runTransformations() error {
 	_, tool := filepath.Split(flag.Args()[0])
@@ -223,6 +542,9 @@ func runTransformations() error {
 		return fmt.Errorf("unknown tool: %q", tool)
 	}
 	transformed := flag.Args()[1:]
+	if isToolVersion(transformed) {
+		return runToolVersion(flag.Args()[0], transformed)
+	}
 	//log.Println(tool, transformed)
 	if transform != nil {
 		var err error
@@ -230,6 +552,10 @@ func runTransformations() error {
 			return err
 		}
 	}
+	transformed, err := obfuscateImportPaths(tool, transformed)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		for _, fn := range deferred {
 			if err := fn(); err != nil {
@@ -253,35 +579,37 @@ func getSalt() string {
 	return os.Getenv("SALT")
 }
 
-func setSalt() error {
-	salt := os.Getenv("SALT")
-	if salt != "" {
-		// salt has already been set
-		return nil
+func setSalt(seedSalt string, writeFile bool) error {
+	salt := seedSalt
+	if salt == "" {
+		salt = os.Getenv("SALT")
 	}
-
-	salt = uniuri.NewLen(50)
-	err := os.Setenv("SALT", salt)
-
-	// write salt to file
-	log.Println("Writing salt to file. The salt is needed to ungarble stacktraces in log files.")
-	err = ioutil.WriteFile("salt.txt", []byte(salt), 0644)
-	if err != nil {
+	if salt == "" {
+		salt = uniuri.NewLen(50)
+	}
+	if err := os.Setenv("SALT", salt); err != nil {
 		return err
 	}
 
-	return  err
+	// Anyone with the salt and the source can undo the obfuscation, so it's
+	// only written in plain text when asked to. Otherwise, keep it in an
+	// encrypted bundle, or use a seed.
+	if !writeFile {
+		return nil
+	}
+	log.Println("Writing salt to salt.txt. The salt is needed to ungarble stacktraces in log files.")
+	return ioutil.WriteFile("salt.txt", []byte(salt), 0600)
 }
 
 var transformFuncs = map[string]func([]string) ([]string, error){
+	"asm":     transformAsm,
+	"cgo":     transformCgo,
 	"compile": transformCompile,
 	"link":    transformLink,
 
 	"addr2line": nil,
 	"api":       nil,
-	"asm":       nil,
 	"buildid":   nil,
-	"cgo":       nil,
 	"cover":     nil,
 	"dist":      nil,
 	"doc":       nil,
@@ -314,7 +642,7 @@ func transformCompile(args []string) ([]string, error) {
 	}
 
 	// filters based on 'only', and 'exclude' command line flags
-	if !shouldGarble(args) {
+	if !shouldGarble(flags) {
 		return args, nil
 	}
 
@@ -340,15 +668,45 @@ func transformCompile(args []string) ([]string, error) {
 		files = append(files, file)
 	}
 
+	if packageHasDirective(files, ignoreDirective) {
+		return args, nil
+	}
+
 	info := &types.Info{
-		Defs: make(map[*ast.Ident]types.Object),
-		Uses: make(map[*ast.Ident]types.Object),
+		Types:     make(map[ast.Expr]types.TypeAndValue),
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+		Scopes:    make(map[ast.Node]*types.Scope),
 	}
 	pkgPath := flagValue(flags, "-p")
+	buildInfo.pkgPath = pkgPath
+	if err := applyPackageOverrides(compiledPackagePath(flags)); err != nil {
+		return nil, err
+	}
+	if hashed, ok := garbledPackagePath(pkgPath); ok {
+		symbols[symbolmap.Entry{
+			Original: pkgPath,
+			Hash:     hashed,
+			Package:  pkgPath,
+			Kind:     symbolmap.KindPackage,
+		}] = true
+	}
 
-	if _, err := origTypesConfig.Check(pkgPath, fset, files, info); err != nil {
+	pkg, err := origTypesConfig.Check(pkgPath, fset, files, info)
+	if err != nil {
 		return nil, fmt.Errorf("typecheck error: %v", err)
 	}
+	buildInfo.pkg = pkg
+	buildInfo.noControlFlow = packageHasDirective(files, noControlFlowDirective)
+	buildInfo.directives = collectDirectives(files)
+	buildInfo.hasAsm = flagValue(flags, "-symabis") != ""
+	buildInfo.linknamed = linknamedNames(files)
+
+	obfuscateLiterals := os.Getenv("SKIP_STRINGS") != "TRUE" && !packageHasDirective(files, noStringsDirective)
+	if obfuscateLiterals {
+		stringsG.ConstsToVars(fset, files, info, pkg, buildInfo.directives.skipLiterals)
+	}
 
 	outDir, err := getGarbledCodeOutputDir()
 	if err != nil {
@@ -367,79 +725,166 @@ func transformCompile(args []string) ([]string, error) {
 	log.Print("")
 
 	// TODO: randomize the order of the files
+	names := make([]string, len(files))
 	for i, file := range files {
 		origName := filepath.Base(filepath.Clean(paths[i]))
 
 		newName := hashing.HashFileName(getSalt(), origName, file)
 
 		name := fmt.Sprintf("%s.go", newName)
-		
+
 		switch {
 		case strings.HasPrefix(origName, "_cgo_"):
-			// Cgo generated code requires a prefix. Also, don't
-			// garble it, since it's just generated code and it gets
-			// messy.
+			// Cgo generated code requires a prefix. Also, only
+			// garble the names it uses from the user's code, since
+			// C code and the runtime rely on the rest.
 			name = "_cgo_" + name
+			file = transformCgoGenerated(file, info)
 		default:
+			// The literals are replaced first, as the new idents
+			// must be renamed too. The keys and decoders only go
+			// in afterwards, as they're not in info.
+			var literalDecls []ast.Decl
+			if obfuscateLiterals {
+				var names []string
+				if literals := os.Getenv("LITERALS"); literals != "" {
+					names = strings.Split(literals, ",")
+				}
+				literalDecls, err = stringsG.ObfuscateLiterals(file, origName, info, buildInfo.pkg, getSalt(), names, buildInfo.directives.skipLiterals)
+				if err != nil {
+					return nil, err
+				}
+			}
 			//fmt.Printf("transforming %s\n", name)
 			file = transformGo(file, info)
+			file.Decls = append(file.Decls, literalDecls...)
 		}
-		tempFile := filepath.Join(outDir, name)
-		f, err := os.Create(tempFile)
-		if err != nil {
-			return nil, err
-		}
-		defer f.Close()
+		files[i], names[i] = file, name
+	}
+
+	// The directives can only be rewritten once all the names they refer
+	// to in this package are hashed.
+	rewriteLinknames(files, info)
+
+	for i, file := range files {
+		origName := filepath.Base(filepath.Clean(paths[i]))
+		name := names[i]
+		symbols[symbolmap.Entry{
+			Original: origName,
+			Hash:     strings.TrimSuffix(name, ".go"),
+			Package:  pkgPath,
+			Kind:     symbolmap.KindFile,
+		}] = true
+		var src bytes.Buffer
 		// printerConfig.Fprint(os.Stderr, fset, file)
-		if err := printerConfig.Fprint(f, fset, file); err != nil {
+		if err := printerConfig.Fprint(&src, fset, file); err != nil {
 			return nil, err
 		}
-		if err := f.Close(); err != nil {
-			return nil, err
+		if os.Getenv("OBFUSCATE_LINES") == "TRUE" && !strings.HasPrefix(origName, "_cgo_") {
+			newSrc, table, err := obfuscateLines(src.Bytes(), file, name)
+			if err != nil {
+				return nil, err
+			}
+			table.Package = pkgPath
+			table.Original = origName
+			lineTables = append(lineTables, table)
+			src.Reset()
+			src.Write(newSrc)
 		}
-		args = append(args, f.Name())
-	}
-
-	// obfuscate strings
-	if os.Getenv("SKIP_STRINGS") != "TRUE" {
-		err = stringsG.ObfuscateStrings(outDir)
-		if err != nil {
-			log.Println(err)
+		tempFile := filepath.Join(outDir, name)
+		if err := ioutil.WriteFile(tempFile, src.Bytes(), 0666); err != nil {
 			return nil, err
 		}
+		args = append(args, tempFile)
 	}
 
+	if err := writeSymbols(); err != nil {
+		return nil, err
+	}
 
 	return args, nil
 }
 
-// filters based on 'only' and 'exclude' command line flags
-func shouldGarble(args []string) bool {
-	currentPackageName := pkgNameFromBuildArgs(args)
-
-	onlyThisPkgName := os.Getenv("ONLY")
-	if onlyThisPkgName != "" && !strings.HasPrefix(currentPackageName, onlyThisPkgName) {
-		return false
+// writeSymbols writes the names hashed in this package as a fragment of the
+// map file, which 'garble build' merges once the whole build is done.
+func writeSymbols() error {
+	dir := os.Getenv("GARBLE_MAP_DIR")
+	if dir == "" {
+		return nil // not run via 'garble build'
 	}
+	fragment := &symbolmap.Map{Lines: lineTables}
+	for entry := range symbols {
+		fragment.Entries = append(fragment.Entries, entry)
+	}
+	// The build ID is unique per compiled package, even when the same
+	// package is compiled twice for a test.
+	return symbolmap.WriteFragment(dir, buildInfo.buildID, getSalt(), fragment)
+}
 
-	excludeEnvVal := os.Getenv("EXCLUDE")
-	if excludeEnvVal != "" {
-		exclude := strings.Split(os.Getenv("EXCLUDE"), ",")
-		for _, pkgName := range exclude {
-			if strings.HasPrefix(currentPackageName, pkgName) {
-				return false
-			}
+// recordSymbol adds a hashed declaration to the map file.
+func recordSymbol(node *ast.Ident, obj types.Object, hashed string) {
+	entry := symbolmap.Entry{
+		Original: node.Name,
+		Hash:     hashed,
+		Package:  buildInfo.pkgPath,
+		Position: symbolPosition(node.Pos()),
+	}
+	switch x := obj.(type) {
+	case *types.Var:
+		if x.IsField() {
+			entry.Kind = symbolmap.KindField
+		} else {
+			entry.Kind = symbolmap.KindVar
 		}
+	case *types.Const:
+		entry.Kind = symbolmap.KindConst
+	case *types.TypeName:
+		entry.Kind = symbolmap.KindType
+	case *types.Func:
+		if x.Type().(*types.Signature).Recv() != nil {
+			entry.Kind = symbolmap.KindMethod
+		} else {
+			entry.Kind = symbolmap.KindFunc
+		}
+	default:
+		// symbolic var v in v := expr.(type)
+		entry.Kind = symbolmap.KindVar
 	}
+	symbols[entry] = true
+}
+
+// symbolPosition formats pos for the map file, relative to the directory
+// garble was run from when possible, to not leak the user's filesystem.
+func symbolPosition(pos token.Pos) string {
+	position := fset.Position(pos)
+	if rel, err := filepath.Rel(os.Getenv("GARBLE_DIR"), position.Filename); err == nil && !strings.HasPrefix(rel, "..") {
+		position.Filename = filepath.ToSlash(rel)
+	} else {
+		position.Filename = filepath.Base(position.Filename)
+	}
+	return position.String()
+}
 
-	return true
+// shouldGarble returns whether the package being compiled is garbled, given
+// the compiler's flags.
+func shouldGarble(flags []string) bool {
+	garbled, _ := shouldGarblePath(compiledPackagePath(flags), flagValue(flags, "-p") == "main")
+	return garbled
 }
 
-func pkgNameFromBuildArgs(args []string) string {
-	pathArg := args[3]
-	pathArgSplit := strings.Split(pathArg, "=>")
-	packageName := pathArgSplit[len(pathArgSplit)-1]
-	return packageName
+// compiledPackagePath returns the import path of the package being compiled.
+// Main packages are compiled with "-p main", so their import path comes from
+// the first rewrite in -trimpath instead, which maps their directory to it.
+func compiledPackagePath(flags []string) string {
+	pkgPath := flagValue(flags, "-p")
+	if pkgPath != "main" {
+		return pkgPath
+	}
+	rewrite := strings.Split(flagValue(flags, "-trimpath"), ";")[0]
+	if i := strings.Index(rewrite, "=>"); i >= 0 && rewrite[i+2:] != "" {
+		return rewrite[i+2:]
+	}
+	return pkgPath
 }
 
 // Either return the directory specified by the user, or
@@ -544,7 +989,7 @@ func buildidOf(path string) (string, error) {
 
 // for debugging
 func reasonNotHashed(name, reason, path string) {
-	fmt.Printf("Name: %s, Reason: %s Path: %s \n", name, reason, path);
+	fmt.Printf("Name: %s, Reason: %s Path: %s \n", name, reason, path)
 }
 
 // transformGo garbles the provided Go syntax node.
@@ -564,10 +1009,34 @@ func transformGo(file *ast.File, info *types.Info) *ast.File {
 		}
 	}
 
+	if os.Getenv("CONTROL_FLOW") == "TRUE" && !buildInfo.noControlFlow {
+		flattenControlFlow(file, info, buildInfo.pkg)
+	}
+
+	return renameIdents(file, info, false)
+}
+
+// transformCgoGenerated renames the references in a file generated by cgo to
+// the names declared by the user, such as the calls to //export funcs. The
+// rest of the generated glue is left as is.
+func transformCgoGenerated(file *ast.File, info *types.Info) *ast.File {
+	return renameIdents(file, info, true)
+}
+
+// isCgoGenerated returns whether pos is in a file generated by cgo, whose
+// declarations keep their names, as C code and the runtime refer to them.
+func isCgoGenerated(pos token.Pos) bool {
+	file := fset.File(pos)
+	return file != nil && strings.HasPrefix(filepath.Base(file.Name()), "_cgo_")
+}
+
+// renameIdents hashes the names in a file. With onlyUserNames, only the
+// names which were declared outside of cgo's generated files are renamed.
+func renameIdents(file *ast.File, info *types.Info, onlyUserNames bool) *ast.File {
 	pre := func(cursor *astutil.Cursor) bool {
-		
+
 		switch node := cursor.Node().(type) {
-			
+
 		case *ast.Ident:
 			//fmt.Println("Original node name: ", node.Name)
 
@@ -575,11 +1044,17 @@ func transformGo(file *ast.File, info *types.Info) *ast.File {
 				return true // unnamed remains unnamed
 			}
 
-			if strings.HasPrefix(node.Name, "_C") || strings.Contains(node.Name, "_cgo") {
+			if isCgoName(node.Name) {
 				return true // don't mess with cgo-generated code
 			}
 
 			obj := info.ObjectOf(node)
+			if obj != nil && isCgoGenerated(obj.Pos()) {
+				return true // such as the fields of C structs
+			}
+			if onlyUserNames && (obj == nil || obj.Pkg() != buildInfo.pkg) {
+				return true
+			}
 
 			// log.Printf("%#v %T", node, obj)
 
@@ -588,34 +1063,15 @@ func transformGo(file *ast.File, info *types.Info) *ast.File {
 			case *types.Var:
 				if x.Embedded() {
 					obj = objOf(obj.Type())
-				} else if x.IsField() && x.Exported() {
-					// might be used for reflection, e.g.
-					// encoding/json without struct tags
-					//reasonNotHashed(node.Name, "Might be used for reflection", "")
-					return true
 				}
 
 			case *types.Const:
 			case *types.TypeName:
 			case *types.Func:
-				sign := obj.Type().(*types.Signature)
-				if obj.Exported() && sign.Recv() != nil {
-					//reasonNotHashed(node.Name, "Might implement an interface", "")
-					return true // might implement an interface
-				}
-				if implementedOutsideGo(x) {
+				if implementedOutsideGo(x) && !buildInfo.hasAsm && !buildInfo.linknamed[x.Name()] {
 					//reasonNotHashed(node.Name, "implemented outside go", "")
 					return true // give up in this case
 				}
-				switch node.Name {
-				case "main", "init", "TestMain":
-					//reasonNotHashed(node.Name, "files we don't want to break", "")
-					return true // don't break them
-				}
-				if strings.HasPrefix(node.Name, "Test") && isTestSignature(sign) {
-					//reasonNotHashed(node.Name, "Is test", "")
-					return true // don't break tests
-				}
 
 			case nil:
 				switch cursor.Parent().(type) {
@@ -629,6 +1085,9 @@ func transformGo(file *ast.File, info *types.Info) *ast.File {
 				//reasonNotHashed(node.Name, "hit default in main case", "")
 				return true // we only want to rename the above
 			}
+			if obj != nil && obj.Pkg() != nil && keepsName(objectName(obj), buildInfo.directives, obj.Pkg().Path()) {
+				return true
+			}
 			//buildID := buildInfo.buildID
 			if obj != nil {
 				pkg := obj.Pkg()
@@ -658,46 +1117,23 @@ func transformGo(file *ast.File, info *types.Info) *ast.File {
 			}
 			//orig := node.Name
 
-			node.Name = hashing.HashWith(getSalt(), node.Name)
+			hashed := hashing.HashWith(getSalt(), node.Name)
+			if def, ok := info.Defs[node]; ok && def == obj {
+				// only record declarations, and not embedded
+				// fields, which declare nothing new
+				recordSymbol(node, obj, hashed)
+			}
+			node.Name = hashed
 			// node.Name = hashing.HashWith(buildID, node.Name)
 
 			//log.Printf("%q hashed with %q to %q", orig, buildID, node.Name)
 		}
-		
+
 		return true
 	}
 	return astutil.Apply(file, pre, nil).(*ast.File)
 }
 
-func isStandardLibrary(path string) bool {
-
-	if path == "main" {
-		// Main packages may not have fully qualified import paths, but
-		// they're not part of the standard library
-		return false
-	}
-
-	// include user defined packages that don't have a fully qualified import path
-	includeEnv := os.Getenv("INCLUDE")
-	if includeEnv != "" { // if we don't do this check, and it's empty, everything will match
-		include := strings.Split(includeEnv, ",")
-		for _, pkgName := range include {
-			if strings.HasPrefix(path, pkgName) {
-				fmt.Println("Has prefix")
-				return false
-			}
-		}
-	}
-
-	onlyEnv := os.Getenv("ONLY")
-	if onlyEnv != "" {
-		return !strings.HasPrefix(path, onlyEnv)
-	}
-
-
-	return !strings.Contains(path, ".")
-}
-
 // implementedOutsideGo returns whether a *types.Func does not have a body, for
 // example when it's implemented in assembly, or when one uses go:linkname.
 //
@@ -734,15 +1170,150 @@ func isTestSignature(sign *types.Signature) bool {
 	return obj != nil && obj.Pkg().Path() == "testing" && obj.Name() == "T"
 }
 
-func transformLink(args []string) ([]string, error) {
+// declaredName describes a name declared in the package being garbled, with
+// what keepsName needs to know about it. It's filled in from the type-checked
+// objects by renameIdents, and from the syntax alone by the assembly side,
+// which runs before the package is compiled.
+type declaredName struct {
+	name string
+	pos  token.Pos // of the identifier which declares it
+
+	topLevel bool // declared in the package scope
+	field    bool
+	fn       bool // a func or a method
+	method   bool
+	recv     string // the name of a method's receiver type
+	test     bool   // a func with the signature of a test
+}
 
-	flags, paths := splitFlagsFromFiles(args, ".a")
-	if len(paths) == 0 {
+// keepsName returns whether a declared name keeps its original name. The
+// names kept by the directives in the package are looked up in d, and the
+// ones kept for a //go:linkname under pkgPath.
+func keepsName(n declaredName, d *sourceDirectives, pkgPath string) bool {
+	switch {
+	case n.name == "_" || isCgoName(n.name):
+		return true
+	case n.field && ast.IsExported(n.name) && !garbleExportedField(n.name):
+		// might be used for reflection, e.g.
+		// encoding/json without struct tags
+		return true
+	case n.method && ast.IsExported(n.name) && !garbleExportedMethod(n.name):
+		return true // might implement an interface
+	case n.fn && (n.name == "main" || n.name == "init" || n.name == "TestMain" || n.test):
+		return true // don't break them
+	}
+	if d != nil && (d.kept[n.pos] || (n.field || n.method) && d.keptMembers[n.name]) {
+		return true // kept by a //garble: directive
+	}
+	// linked to by name from elsewhere
+	return n.topLevel && linknameKept(pkgPath, n.name) ||
+		n.recv != "" && linknameKept(pkgPath, n.recv+"."+n.name)
+}
+
+// objectName describes an object of the package being compiled, or of one
+// of its imports, for keepsName.
+func objectName(obj types.Object) declaredName {
+	n := declaredName{
+		name:     obj.Name(),
+		pos:      obj.Pos(),
+		topLevel: obj.Pkg() == buildInfo.pkg && obj.Parent() == buildInfo.pkg.Scope(),
+	}
+	switch obj := obj.(type) {
+	case *types.Var:
+		n.field = obj.IsField()
+	case *types.Func:
+		sign := obj.Type().(*types.Signature)
+		n.fn = true
+		if recv := sign.Recv(); recv != nil {
+			n.method = true
+			typ := recv.Type()
+			if ptr, ok := typ.(*types.Pointer); ok {
+				typ = ptr.Elem()
+			}
+			if named, ok := typ.(*types.Named); ok {
+				n.recv = named.Obj().Name()
+			}
+		}
+		n.test = strings.HasPrefix(n.name, "Test") && isTestSignature(sign)
+	}
+	return n
+}
+
+// funcDeclName describes a func declaration for keepsName, like objectName
+// does for its object.
+func funcDeclName(decl *ast.FuncDecl) declaredName {
+	n := declaredName{
+		name:     decl.Name.Name,
+		pos:      decl.Name.Pos(),
+		topLevel: decl.Recv == nil,
+		fn:       true,
+		method:   decl.Recv != nil,
+	}
+	if decl.Recv != nil && len(decl.Recv.List) == 1 {
+		// Like objectName, going by the syntax of the receiver.
+		typ := decl.Recv.List[0].Type
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ = star.X
+		}
+		switch t := typ.(type) {
+		case *ast.IndexExpr:
+			typ = t.X
+		case *ast.IndexListExpr:
+			typ = t.X
+		}
+		if ident, ok := typ.(*ast.Ident); ok {
+			n.recv = ident.Name
+		}
+	}
+	if params := decl.Type.Params.List; decl.Recv == nil && strings.HasPrefix(n.name, "Test") &&
+		len(params) == 1 && len(params[0].Names) <= 1 {
+		// Like isTestSignature, going by the name of the import.
+		star, _ := params[0].Type.(*ast.StarExpr)
+		if star != nil {
+			if sel, ok := star.X.(*ast.SelectorExpr); ok {
+				x, ok := sel.X.(*ast.Ident)
+				n.test = ok && x.Name == "testing" && sel.Sel.Name == "T"
+			}
+		}
+	}
+	return n
+}
+
+func transformLink(args []string) ([]string, error) {
+	// The main package is the last argument. It's not always an .a file, as
+	// it's passed straight from the build cache when its compile was cached.
+	if len(args) == 0 || strings.HasPrefix(args[len(args)-1], "-") {
 		// Nothing to transform; probably just ["-V=full"].
 		return args, nil
 	}
+	flags, paths := args[:len(args)-1:len(args)-1], args[len(args)-1:]
 	flags = append(flags, "-w", "-s")
 
+	// Since Go 1.18, the module info isn't compiled from _gomod_.go, but
+	// given to the linker in a modinfo line of its importcfg.
+	importcfg := flagValue(flags, "-importcfg")
+	if importcfg == "" {
+		return append(flags, paths...), nil
+	}
+	data, err := ioutil.ReadFile(importcfg)
+	if err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if verb, _ := splitImportcfgLine(line); verb == "modinfo" {
+			// never include module info
+			continue
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() == len(data) {
+		return append(flags, paths...), nil
+	}
+	flags, err = writeImportcfg(flags, buf.String())
+	if err != nil {
+		return nil, err
+	}
 	return append(flags, paths...), nil
 }
 
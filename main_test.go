@@ -6,12 +6,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rogpeppe/go-internal/goproxytest"
 	"github.com/rogpeppe/go-internal/gotooltest"
@@ -21,9 +22,12 @@ import (
 var proxyURL string
 
 func TestMain(m *testing.M) {
-	os.Exit(testscript.RunMain(garbleMain{m}, map[string]func() int{
-		"garble": main1,
-	}))
+	// testscript installs a copy of the test binary as garble in $PATH.
+	// It must not be a symlink, as -toolexec would then run the test
+	// binary by its own name, and end up in garbleMain.Run.
+	testscript.Main(garbleMain{m}, map[string]func(){
+		"garble": func() { os.Exit(main1()) },
+	})
 }
 
 type garbleMain struct {
@@ -53,18 +57,6 @@ func TestScripts(t *testing.T) {
 				"GOPROXY="+proxyURL,
 				"GONOSUMDB=*",
 			)
-			bindir := filepath.Join(env.WorkDir, ".bin")
-			if err := os.Mkdir(bindir, 0777); err != nil {
-				return err
-			}
-			binfile := filepath.Join(bindir, "garble")
-			if runtime.GOOS == "windows" {
-				binfile += ".exe"
-			}
-			if err := os.Symlink(os.Args[0], binfile); err != nil {
-				return err
-			}
-			env.Vars = append(env.Vars, fmt.Sprintf("PATH=%s%c%s", bindir, filepath.ListSeparator, os.Getenv("PATH")))
 			env.Vars = append(env.Vars, "TESTSCRIPT_COMMAND=garble")
 			return nil
 		},
@@ -150,3 +142,46 @@ func TestFlagValue(t *testing.T) {
 		})
 	}
 }
+
+func TestTrimMapCache(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"used.bin":   time.Hour,
+		"unused.bin": 6 * 24 * time.Hour,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := trimMapCache(dir, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "used.bin")); err != nil {
+		t.Fatalf("recently used fragment was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unused.bin")); !os.IsNotExist(err) {
+		t.Fatalf("unused fragment was kept: %v", err)
+	}
+
+	// Trimming again soon after does nothing, even for old fragments.
+	path := filepath.Join(dir, "old.bin")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-10 * 24 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := trimMapCache(dir, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("fragment was removed before the trim interval: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exported methods are only garbled when no interface in the whole build
+// could require them, and when their type can't reach reflection, as found by
+// collectKeptFields. Since each package is compiled in a separate process,
+// 'garble build' runs the analysis once upfront, and writes the names of the
+// methods to keep to a file, which is passed on via $KEEP_METHODS_FILE.
+
+// keptMethods is loaded from $KEEP_METHODS_FILE on first use.
+var keptMethods map[string]bool
+
+// listedPackage is the subset of 'go list -json' that we need.
+type listedPackage struct {
+	ImportPath string
+	Name       string
+	Dir        string
+	GoFiles    []string
+	CgoFiles   []string
+	SFiles     []string
+	Export     string
+	BuildID    string
+	Standard   bool
+}
+
+// listPackages runs 'go list -deps' on the packages being built. With -test,
+// the test variants of packages are listed separately, and their GoFiles
+// include the test files.
+func listPackages(goFlags, patterns []string, test, export bool) ([]listedPackage, error) {
+	args := []string{"list", "-deps", "-json"}
+	if test {
+		args = append(args, "-test")
+	}
+	if export {
+		args = append(args, "-export")
+	}
+	args = append(args, listFlags(goFlags)...)
+	args = append(args, patterns...)
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var pkgs []listedPackage
+	decoder := json.NewDecoder(bufio.NewReader(out))
+	for {
+		var pkg listedPackage
+		if err := decoder.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("go list error: %v", err)
+	}
+	return pkgs, nil
+}
+
+// listFlags drops the build flags which 'go list' doesn't accept, such as the
+// output path.
+func listFlags(goFlags []string) []string {
+	var flags []string
+	for i := 0; i < len(goFlags); i++ {
+		flag := goFlags[i]
+		switch {
+		case flag == "-o":
+			i++ // skip its value too
+		case strings.HasPrefix(flag, "-o="):
+		default:
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// files returns the absolute paths of the Go files in the package.
+func (p listedPackage) files() []string {
+	var files []string
+	for _, name := range append(p.GoFiles, p.CgoFiles...) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(p.Dir, name)
+		}
+		files = append(files, name)
+	}
+	return files
+}
+
+// garbled returns whether the names in a package are garbled at all, given
+// its parsed files. The packages we leave alone keep all of their field and
+// method names, so the analyses must keep those names in every package.
+func (p listedPackage) garbled(files []*ast.File) bool {
+	if p.Standard {
+		return false
+	}
+	garbled, _ := shouldGarblePath(plainImportPath(p.ImportPath), p.Name == "main")
+	return garbled && !packageHasDirective(files, ignoreDirective)
+}
+
+// collectKeptMethods parses every package in the build, including the
+// standard library, and returns the names of all the methods which must not
+// be renamed. Those are the methods declared by any interface type, such as
+// fmt.Stringer or io.Reader, and the names given to reflect's MethodByName.
+//
+// The analysis is by name only, since an exported method satisfies an
+// interface as long as the names and signatures match, even across packages
+// which don't know about each other. Methods kept by a //garble:keepname or
+// //garble:ignore directive are kept by name too.
+func collectKeptMethods(pkgs []listedPackage) map[string]bool {
+	kept := make(map[string]bool)
+	for _, pkg := range pkgs {
+		// Only code we garble can have directives for us.
+		var mode parser.Mode
+		if !pkg.Standard {
+			mode = parser.ParseComments
+		}
+		var files []*ast.File
+		for _, path := range pkg.files() {
+			file, err := parser.ParseFile(token.NewFileSet(), path, nil, mode)
+			if err != nil {
+				// The compiler will report the error; we needn't do it twice.
+				continue
+			}
+			files = append(files, file)
+		}
+		// The methods of the other packages we don't garble, such as
+		// the ones left out with --exclude, are all kept, as their
+		// callers don't know they weren't garbled.
+		garbled := pkg.garbled(files)
+		for _, file := range files {
+			collectFileKeptMethods(file, kept)
+			if !pkg.Standard {
+				collectKeptMembers(file, !garbled, kept)
+			}
+		}
+	}
+	return kept
+}
+
+func collectFileKeptMethods(file *ast.File, kept map[string]bool) {
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.InterfaceType:
+			for _, field := range node.Methods.List {
+				if _, ok := field.Type.(*ast.FuncType); !ok {
+					continue // an embedded interface or constraint
+				}
+				for _, name := range field.Names {
+					kept[name.Name] = true
+				}
+			}
+		case *ast.CallExpr:
+			sel, ok := node.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "MethodByName" || len(node.Args) != 1 {
+				break
+			}
+			if lit, ok := node.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if name, err := strconv.Unquote(lit.Value); err == nil {
+					kept[name] = true
+				}
+			}
+		}
+		return true
+	})
+}
+
+// writeNames writes a set of names one per line to a temporary file, so that
+// the compiler processes can load them with readNames.
+func writeNames(names map[string]bool, pattern string) (string, error) {
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, strings.Join(list, "\n")); err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// readNames loads a file written by writeNames.
+func readNames(path string) map[string]bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err) // written by 'garble build'; shouldn't happen
+	}
+	names := make(map[string]bool)
+	for _, name := range strings.Split(string(data), "\n") {
+		names[name] = true
+	}
+	return names
+}
+
+// garbleExportedMethod returns whether an exported method can be renamed,
+// which is never the case unless 'garble build' ran the analysis.
+func garbleExportedMethod(name string) bool {
+	path := os.Getenv("KEEP_METHODS_FILE")
+	if path == "" {
+		return false
+	}
+	if keptMethods == nil {
+		keptMethods = readNames(path)
+	}
+	return !keptMethods[name]
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Package patterns select packages for --only, --include, --exclude and the
+// overrides in the config file. They work like the ones for go list:
+//
+//	foo.com/bar        just that package
+//	foo.com/bar/...    that package and all the ones below it
+//	foo.com/.../util   ... matches any string, including slashes
+//	./...              relative to the current directory
+//	re:^foo\.com/v\d/  a regular expression, which may match anywhere
+//
+// A pattern starting with ! takes back what the patterns before it matched,
+// so that "foo.com/...", "!foo.com/keep" matches everything in foo.com but
+// foo.com/keep. The last pattern which matches a package decides.
+
+const regexpPrefix = "re:"
+
+// matchPattern returns whether an import path matches a single pattern,
+// which must not be negated.
+func matchPattern(pattern, pkgPath string) bool {
+	if strings.HasPrefix(pattern, regexpPrefix) {
+		rx, err := regexp.Compile(strings.TrimPrefix(pattern, regexpPrefix))
+		return err == nil && rx.MatchString(pkgPath)
+	}
+	if !strings.Contains(pattern, "...") {
+		return pattern == pkgPath
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\.\.\.`, `.*`, -1)
+	// Like with go list, foo/... matches foo too.
+	if strings.HasSuffix(expr, `/.*`) {
+		expr = strings.TrimSuffix(expr, `/.*`) + `(/.*)?`
+	}
+	return regexp.MustCompile("^" + expr + "$").MatchString(pkgPath)
+}
+
+// matchPatterns returns whether an import path is selected by a list of
+// patterns, and the pattern which decided it, if any did.
+func matchPatterns(patterns []string, pkgPath string) (matched bool, rule string) {
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if matchPattern(strings.TrimPrefix(pattern, "!"), pkgPath) {
+			matched, rule = !negated, pattern
+		}
+	}
+	return matched, rule
+}
+
+// checkPatterns returns an error for the first pattern which isn't valid.
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "!")
+		if pattern == "" {
+			return errors.New("Empty package pattern")
+		}
+		if strings.HasPrefix(pattern, regexpPrefix) {
+			if _, err := regexp.Compile(strings.TrimPrefix(pattern, regexpPrefix)); err != nil {
+				return errors.Wrapf(err, "Invalid package pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// resolvePatterns turns the relative patterns, like ./..., into import paths
+// within the main module, as the toolexec processes only see import paths.
+func resolvePatterns(patterns []string) ([]string, error) {
+	var resolved []string
+	for _, pattern := range patterns {
+		neg := ""
+		if strings.HasPrefix(pattern, "!") {
+			neg, pattern = "!", pattern[1:]
+		}
+		if pattern == "." || strings.HasPrefix(pattern, "./") || pattern == ".." || strings.HasPrefix(pattern, "../") {
+			var err error
+			if pattern, err = relativeImportPath(pattern); err != nil {
+				return nil, err
+			}
+		}
+		resolved = append(resolved, neg+pattern)
+	}
+	return resolved, nil
+}
+
+func relativeImportPath(pattern string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	root, err := findModuleRoot()
+	if err != nil {
+		return "", err
+	}
+	if root == "" {
+		return "", errors.Errorf("Cannot use the relative package pattern %q outside of a module", pattern)
+	}
+	modPath, err := modulePath(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, filepath.Join(wd, filepath.FromSlash(pattern)))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("The package pattern %q is outside of the main module", pattern)
+	}
+	return path.Join(modPath, filepath.ToSlash(rel)), nil
+}
+
+// findModuleRoot returns the directory holding the go.mod file of the main
+// module, or an empty string if there's none.
+func findModuleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func modulePath(gomod string) (string, error) {
+	data, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(fields[1]); err == nil {
+			return unquoted, nil
+		}
+		return fields[1], nil
+	}
+	return "", errors.Errorf("No module path in %s", gomod)
+}
+
+// envPatterns returns the patterns passed on by 'garble build' in an
+// environment variable. They're one per line, as regular expressions can
+// have commas.
+func envPatterns(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, "\n")
+}
+
+// shouldGarblePath returns whether the names in a package are garbled,
+// following --only, --exclude and --include, along with the rule which
+// decided it, as shown by 'garble list'. Main packages are never taken as
+// part of the standard library, whatever their import path.
+func shouldGarblePath(pkgPath string, main bool) (garbled bool, reason string) {
+	if only := envPatterns("ONLY"); len(only) > 0 {
+		if ok, _ := matchPatterns(only, pkgPath); !ok {
+			return false, "not matched by --only"
+		}
+	}
+	excluded, excludeRule := matchPatterns(envPatterns("EXCLUDE"), pkgPath)
+	if excluded {
+		return false, fmt.Sprintf("--exclude %s", excludeRule)
+	}
+	if !main {
+		if std, reason := standardLibrary(pkgPath); std || reason != "" {
+			return !std, reason
+		}
+	}
+	if excludeRule != "" {
+		return true, fmt.Sprintf("--exclude %s", excludeRule) // negated
+	}
+	return true, "default"
+}
+
+// isStandardLibrary returns whether a package is treated like the standard
+// library, whose names are never garbled.
+func isStandardLibrary(pkgPath string) bool {
+	std, _ := standardLibrary(pkgPath)
+	return std
+}
+
+// standardLibrary returns whether a package is treated like the standard
+// library, and the rule which decided it, if it wasn't the default.
+func standardLibrary(pkgPath string) (std bool, reason string) {
+	if pkgPath == "main" {
+		// Main packages may not have fully qualified import paths, but
+		// they're not part of the standard library
+		return false, "main package"
+	}
+	// include user defined packages that don't have a fully qualified import path
+	if ok, rule := matchPatterns(envPatterns("INCLUDE"), pkgPath); ok {
+		return false, fmt.Sprintf("--include %s", rule)
+	}
+	if only := envPatterns("ONLY"); len(only) > 0 {
+		if ok, rule := matchPatterns(only, pkgPath); ok {
+			return false, fmt.Sprintf("--only %s", rule)
+		}
+		return true, "not matched by --only"
+	}
+	if !strings.Contains(pkgPath, ".") {
+		return true, "no dot in the import path, like the standard library; see --include"
+	}
+	return false, ""
+}
+
+// printPackageList writes which of the packages in a build would be garbled,
+// and the rule which decided it, for 'garble list'. The standard library is
+// left out, as it's never garbled.
+func (f *buildFlagSet) printPackageList(w io.Writer) error {
+	if err := f.packagesToEnv(); err != nil {
+		return err
+	}
+	pkgs, err := listPackages(f.goFlags, f.flagSet.Args()[1:], false, false)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, pkg := range pkgs {
+		if pkg.Standard {
+			continue
+		}
+		garbled, reason := shouldGarblePath(pkg.ImportPath, pkg.Name == "main")
+		decision := "garbled"
+		if !garbled {
+			decision = "not garbled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", pkg.ImportPath, decision, reason)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"mvdan.cc/garble/hashing"
+)
+
+// With --import-paths, every garbled package is compiled with a hashed import
+// path, so that its real path doesn't end up in symbol names, type names, or
+// stack traces. The source still imports the original paths, so each compiler
+// invocation gets an importcfg with importmap lines from the original paths to
+// the hashed ones, and the linker gets the package files under their hashed
+// paths.
+
+// garbledPackagePath returns the hashed import path for a package, and whether
+// the package's path should be hashed at all.
+func garbledPackagePath(path string) (string, bool) {
+	if os.Getenv("OBFUSCATE_IMPORT_PATHS") != "TRUE" {
+		return "", false
+	}
+	if path == "main" || strings.HasPrefix(path, "vendor/") || strings.HasPrefix(path, "cmd/") {
+		return "", false
+	}
+	if garbled, _ := shouldGarblePath(path, false); !garbled {
+		return "", false
+	}
+	return hashing.HashWith(getSalt(), path), true
+}
+
+// obfuscateImportPaths rewrites the arguments of a tool so that it uses the
+// hashed import paths. It runs after the tool's own transformation, since
+// packages which aren't garbled themselves may still import garbled ones.
+func obfuscateImportPaths(tool string, args []string) ([]string, error) {
+	if os.Getenv("OBFUSCATE_IMPORT_PATHS") != "TRUE" {
+		return args, nil
+	}
+	switch tool {
+	case "compile", "asm":
+		if hashed, ok := garbledPackagePath(flagValue(args, "-p")); ok {
+			args = flagSetValue(args, "-p", hashed)
+		}
+	case "link":
+	default:
+		return args, nil
+	}
+	importcfg := flagValue(args, "-importcfg")
+	if importcfg == "" {
+		return args, nil // asm, and compiles without dependencies
+	}
+	data, err := ioutil.ReadFile(importcfg)
+	if err != nil {
+		return nil, err
+	}
+	newData, changed := rewriteImportcfg(string(data), tool == "link")
+	if !changed {
+		return args, nil
+	}
+	return writeImportcfg(args, newData)
+}
+
+// writeImportcfg writes an importcfg to a temporary file, which is removed
+// once the tool is done, and points the -importcfg flag in args at it.
+func writeImportcfg(args []string, data string) ([]string, error) {
+	f, err := ioutil.TempFile("", "garble-importcfg")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	deferred = append(deferred, func() error {
+		return os.Remove(f.Name())
+	})
+	return flagSetValue(args, "-importcfg", f.Name()), nil
+}
+
+// rewriteImportcfg replaces the garbled packages in an importcfg file with
+// their hashed import paths.
+//
+// The compiler resolves the imports in the source, so each garbled package
+// gets an importmap line from its original path. The linker only sees the
+// paths recorded in the object files, which are already hashed.
+func rewriteImportcfg(data string, link bool) (string, bool) {
+	var buf strings.Builder
+	changed := false
+	for _, line := range strings.SplitAfter(data, "\n") {
+		verb, args := splitImportcfgLine(line)
+		i := strings.Index(args, "=")
+		if i < 0 {
+			buf.WriteString(line)
+			continue
+		}
+		from, to := args[:i], args[i+1:]
+		switch verb {
+		case "packagefile":
+			hashed, ok := garbledPackagePath(from)
+			if !ok {
+				break
+			}
+			if !link {
+				fmt.Fprintf(&buf, "importmap %s=%s\n", from, hashed)
+			}
+			fmt.Fprintf(&buf, "packagefile %s=%s\n", hashed, to)
+			changed = true
+			continue
+		case "importmap":
+			if hashed, ok := garbledPackagePath(to); ok {
+				fmt.Fprintf(&buf, "importmap %s=%s\n", from, hashed)
+				changed = true
+				continue
+			}
+		}
+		buf.WriteString(line)
+	}
+	return buf.String(), changed
+}
+
+// splitImportcfgLine splits a line like "packagefile foo=bar" into its verb and
+// arguments.
+func splitImportcfgLine(line string) (verb, args string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+	i := strings.Index(line, " ")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i+1:])
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strings"
+
+	"mvdan.cc/garble/hashing"
+)
+
+// saltFromSeed returns the salt for --seed or --seed-from-git, or an empty
+// string if neither was used. dir is where the module's source is, for
+// --seed-from-git.
+func saltFromSeed(seed string, fromGit bool, dir string) (string, error) {
+	if seed != "" && fromGit {
+		return "", errors.New("Only one of the seed and seed-from-git flags can be used")
+	}
+	if fromGit {
+		var err error
+		if seed, err = gitSeed(dir); err != nil {
+			return "", err
+		}
+	}
+	if seed == "" {
+		return "", nil
+	}
+	return hashing.SaltFromSeed(seed), nil
+}
+
+// gitSeed returns a seed made of the commit checked out in dir, and the
+// contents of the go.mod file of the module in dir. The same commit of the same
+// module always gets the same seed.
+func gitSeed(dir string) (string, error) {
+	commit, err := gitOutput(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	status, err := gitOutput(dir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return "", err
+	}
+	if status != "" {
+		log.Println("Warning: the git tree has uncommitted changes, which aren't part of the seed.")
+	}
+
+	cmd := exec.Command("go", "env", "GOMOD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go env error: %v", err)
+	}
+	gomod := string(bytes.TrimSpace(out))
+	if gomod == "" || gomod == "/dev/null" || gomod == "NUL" {
+		return "", fmt.Errorf("seed-from-git needs a module, but %s isn't in one", dir)
+	}
+	modContent, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return "", err
+	}
+	return "git " + commit + "\n" + string(modContent), nil
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,99 @@
+package strings
+
+import "math/bits"
+
+// aesDecoder is a minimal AES-128 in CTR mode, added to the end of the files
+// which use the aes obfuscator. It only needs to be correct, not fast, as each
+// literal is decrypted once.
+const aesDecoder = `func %[1]s(maskedKey, keyMask, ctr, data string) string {
+	key := []byte(maskedKey)
+	for i := range key {
+		key[i] ^= keyMask[i]
+	}
+	sbox := []byte(%[2]s)
+	xtime := func(b byte) byte { return b<<1 ^ (b>>7)*0x1b }
+
+	// key expansion
+	w := make([]byte, 176)
+	copy(w, key)
+	rcon := byte(1)
+	for i := 16; i < 176; i += 4 {
+		t0, t1, t2, t3 := w[i-4], w[i-3], w[i-2], w[i-1]
+		if i%%16 == 0 {
+			t0, t1, t2, t3 = sbox[t1]^rcon, sbox[t2], sbox[t3], sbox[t0]
+			rcon = xtime(rcon)
+		}
+		w[i], w[i+1], w[i+2], w[i+3] = w[i-16]^t0, w[i-15]^t1, w[i-14]^t2, w[i-13]^t3
+	}
+
+	counter := make([]byte, 16)
+	copy(counter, ctr)
+	out := make([]byte, len(data))
+	state := make([]byte, 16)
+	next := make([]byte, 16)
+	for off := 0; off < len(data); off += 16 {
+		for i := range state {
+			state[i] = counter[i] ^ w[i]
+		}
+		for round := 1; round <= 10; round++ {
+			// SubBytes and ShiftRows
+			for c := 0; c < 4; c++ {
+				for r := 0; r < 4; r++ {
+					next[c*4+r] = sbox[state[(c+r)%%4*4+r]]
+				}
+			}
+			if round < 10 {
+				// MixColumns
+				for c := 0; c < 16; c += 4 {
+					a0, a1, a2, a3 := next[c], next[c+1], next[c+2], next[c+3]
+					all := a0 ^ a1 ^ a2 ^ a3
+					next[c] ^= all ^ xtime(a0^a1)
+					next[c+1] ^= all ^ xtime(a1^a2)
+					next[c+2] ^= all ^ xtime(a2^a3)
+					next[c+3] ^= all ^ xtime(a3^a0)
+				}
+			}
+			for i := range state {
+				state[i] = next[i] ^ w[round*16+i]
+			}
+		}
+		for i := 0; i < 16 && off+i < len(data); i++ {
+			out[off+i] = data[off+i] ^ state[i]
+		}
+		for i := 15; i >= 0; i-- {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+	return string(out)
+}`
+
+// aesSbox computes the AES S-box, from the multiplicative inverses in GF(2^8),
+// by walking the powers of 3 and their inverses together.
+func aesSbox() [256]byte {
+	var sbox [256]byte
+	p, q := byte(1), byte(1)
+	for {
+		// multiply p by 3
+		p = p ^ p<<1 ^ (p>>7)*0x1b
+
+		// divide q by 3
+		q ^= q << 1
+		q ^= q << 2
+		q ^= q << 4
+		if q&0x80 != 0 {
+			q ^= 0x09
+		}
+
+		// the affine transformation
+		x := q ^ bits.RotateLeft8(q, 1) ^ bits.RotateLeft8(q, 2) ^ bits.RotateLeft8(q, 3) ^ bits.RotateLeft8(q, 4)
+		sbox[p] = x ^ 0x63
+		if p == 1 {
+			break
+		}
+	}
+	sbox[0] = 0x63
+	return sbox
+}
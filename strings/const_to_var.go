@@ -1,115 +1,238 @@
 package strings
 
 import (
-	"bytes"
-	"fmt"
 	"go/ast"
-	"go/parser"
 	"go/token"
-	"io/ioutil"
-	"sort"
+	"go/types"
+	"path/filepath"
 	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
 )
 
-func stringConstsToVar(path string) error {
-	contents, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
+// ConstsToVars turns string constants into variables, so that their values
+// can be obfuscated like any other string literal.
+//
+// A constant is only turned into a variable when that can't break the build:
+// it must not be exported, as other packages could use it in constant
+// expressions, and every use in the package must be somewhere a variable of
+// the same type would do. That rules out uses in other constants, in constant
+// expressions like len(c) or c+"suffix", and untyped constants used as a named
+// string type.
+//
+// Declarations and specs in skip, such as those with a //garble:nostrings
+// directive, are left alone.
+//
+// It must run before the files are renamed, as it adds identifiers.
+func ConstsToVars(fset *token.FileSet, files []*ast.File, info *types.Info, pkg *types.Package, skip map[ast.Node]bool) {
+	c := &constToVar{
+		info: info,
+		uses: make(map[*types.Const]int),
+		keep: make(map[*types.Const]bool),
+		skip: skip,
 	}
-
-	set := token.NewFileSet()
-	file, err := parser.ParseFile(set, path, contents, 0)
-	if err != nil {
-		// If the file is invalid, we do nothing.
-		return nil
+	for _, file := range files {
+		c.findUses(file)
 	}
 
-	ctv := &constToVar{}
-	for _, decl := range file.Decls {
-		ast.Walk(ctv, decl)
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(fset.Position(file.Pos()).Filename), "_cgo_") {
+			continue
+		}
+		pre := func(cursor *astutil.Cursor) bool {
+			if c.skip[cursor.Node()] {
+				return false
+			}
+			switch node := cursor.Node().(type) {
+			case *ast.GenDecl:
+				if _, ok := cursor.Parent().(*ast.File); ok {
+					if vars := c.convert(node, pkg); vars != nil {
+						cursor.InsertAfter(vars)
+					}
+				}
+				return false
+			case *ast.DeclStmt:
+				if vars := c.convert(node.Decl.(*ast.GenDecl), pkg); vars != nil {
+					cursor.InsertAfter(&ast.DeclStmt{Decl: vars})
+				}
+				return false
+			}
+			return true
+		}
+		astutil.Apply(file, pre, nil)
 	}
-	sort.Sort(ctv)
+}
 
-	var resBuf bytes.Buffer
-	var lastIdx int
-	for _, decl := range ctv.Decls {
-		start := int(decl.Pos() - 1)
-		end := int(decl.End() - 1)
-		resBuf.Write(contents[lastIdx:start])
-		declData := contents[start:end]
-		varData := strings.Replace(string(declData), "const", "var", 1)
-		resBuf.WriteString(varData)
-		lastIdx = end
-	}
-	resBuf.Write(contents[lastIdx:])
+type constToVar struct {
+	info *types.Info
 
-	return ioutil.WriteFile(path, resBuf.Bytes(), 0755)
+	uses map[*types.Const]int
+	keep map[*types.Const]bool
+	skip map[ast.Node]bool
 }
 
-type constToVar struct {
-	Decls []*ast.GenDecl
+// findUses counts the uses of each constant in a file, and records those
+// which are used where only a constant will do.
+func (c *constToVar) findUses(file *ast.File) {
+	var stack []ast.Node
+	ast.Inspect(file, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, node)
+		id, ok := node.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj, ok := c.info.Uses[id].(*types.Const)
+		if !ok {
+			return true
+		}
+		c.uses[obj]++
+		if c.constantUse(id, obj, stack[:len(stack)-1]) {
+			c.keep[obj] = true
+		}
+		return true
+	})
 }
 
-func (c *constToVar) Visit(n ast.Node) ast.Visitor {
-	if decl, ok := n.(*ast.GenDecl); ok {
-		if decl.Tok == token.CONST {
-			if constOnlyHasStrings(decl) {
-				c.Decls = append(c.Decls, decl)
+// constantUse returns whether a use of a constant needs it to stay constant,
+// given the nodes enclosing it.
+func (c *constToVar) constantUse(id *ast.Ident, obj *types.Const, parents []ast.Node) bool {
+	if len(parents) > 0 {
+		if parent, ok := parents[len(parents)-1].(ast.Expr); ok {
+			if tv, ok := c.info.Types[parent]; ok && tv.Value != nil {
+				return true // part of a larger constant expression
 			}
 		}
 	}
-	return c
+	for _, parent := range parents {
+		if decl, ok := parent.(*ast.GenDecl); ok && decl.Tok == token.CONST {
+			return true
+		}
+	}
+	// An untyped constant might be converted to another type here, which
+	// a string variable can't be.
+	tv, ok := c.info.Types[id]
+	return !ok || !types.Identical(tv.Type, types.Default(obj.Type()))
 }
 
-func (c *constToVar) Len() int {
-	return len(c.Decls)
+// convertible returns whether all the constants declared by a spec can be
+// turned into variables.
+func (c *constToVar) convertible(spec *ast.ValueSpec, pkg *types.Package) bool {
+	for _, name := range spec.Names {
+		obj, ok := c.info.Defs[name].(*types.Const)
+		if !ok {
+			return false
+		}
+		basic, ok := obj.Type().Underlying().(*types.Basic)
+		if !ok || basic.Info()&types.IsString == 0 {
+			return false
+		}
+		if obj.Exported() || c.keep[obj] {
+			return false
+		}
+		if obj.Parent() != pkg.Scope() && c.uses[obj] == 0 {
+			return false // an unused local variable is an error
+		}
+	}
+	return true
 }
 
-func (c *constToVar) Swap(i, j int) {
-	c.Decls[i], c.Decls[j] = c.Decls[j], c.Decls[i]
-}
+// convert turns the convertible specs of a const declaration into variables.
+// If all of them are, the declaration itself becomes a var declaration;
+// otherwise, the variables are split off into a new declaration, which is
+// returned to go after the original one.
+func (c *constToVar) convert(decl *ast.GenDecl, pkg *types.Package) *ast.GenDecl {
+	if decl.Tok != token.CONST {
+		return nil
+	}
+	for _, spec := range decl.Specs {
+		spec := spec.(*ast.ValueSpec)
+		// Specs which repeat the previous values, or use iota, depend
+		// on the specs before them.
+		if len(spec.Values) == 0 || c.usesIota(spec) {
+			return nil
+		}
+	}
 
-func (c *constToVar) Less(i, j int) bool {
-	return c.Decls[i].Pos() < c.Decls[j].Pos()
+	var consts, vars []ast.Spec
+	for _, spec := range decl.Specs {
+		spec := spec.(*ast.ValueSpec)
+		if !c.skip[spec] && c.convertible(spec, pkg) && c.typeValues(spec) {
+			vars = append(vars, spec)
+		} else {
+			consts = append(consts, spec)
+		}
+	}
+	switch {
+	case len(vars) == 0:
+		return nil
+	case len(consts) == 0:
+		decl.Tok = token.VAR
+		return nil
+	}
+	decl.Specs = consts
+	return &ast.GenDecl{Tok: token.VAR, Specs: vars}
 }
 
-func constOnlyHasStrings(decl *ast.GenDecl) bool {
-	for _, spec := range decl.Specs {
-		if cs, ok := spec.(*ast.ValueSpec); ok {
-			if !specIsString(cs) {
-				return false
+func (c *constToVar) usesIota(spec *ast.ValueSpec) bool {
+	found := false
+	for _, value := range spec.Values {
+		ast.Inspect(value, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok && c.info.Uses[id] == types.Universe.Lookup("iota") {
+				found = true
 			}
-		}
+			return !found
+		})
 	}
-	return true
+	return found
 }
 
-func specIsString(v *ast.ValueSpec) bool {
-	if v.Type != nil {
-		s, ok := v.Type.(fmt.Stringer)
-		if ok && s.String() == "string" {
-			return true
+// typeValues converts the values of a spec with a named string type to that
+// type, as obfuscated strings are of type string. It returns false if the
+// type can't be written out again.
+func (c *constToVar) typeValues(spec *ast.ValueSpec) bool {
+	if spec.Type == nil {
+		return true
+	}
+	if tv, ok := c.info.Types[spec.Type]; !ok || types.Identical(tv.Type, types.Typ[types.String]) {
+		return true
+	}
+	var typs []ast.Expr
+	for range spec.Values {
+		typ := c.copyType(spec.Type)
+		if typ == nil {
+			return false
 		}
+		typs = append(typs, typ)
 	}
-	if len(v.Values) != 1 {
-		return false
+	for i, value := range spec.Values {
+		spec.Values[i] = &ast.CallExpr{Fun: typs[i], Args: []ast.Expr{value}}
 	}
-	return exprIsString(v.Values[0])
+	return true
 }
 
-func exprIsString(e ast.Expr) bool {
-	switch e := e.(type) {
-	case *ast.BasicLit:
-		if e.Kind == token.STRING {
-			return true
+// copyType copies a type name like T or pkg.T, recording the new identifiers
+// so that they are renamed like the original ones.
+func (c *constToVar) copyType(expr ast.Expr) ast.Expr {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		id := ast.NewIdent(expr.Name)
+		c.info.Uses[id] = c.info.Uses[expr]
+		return id
+	case *ast.SelectorExpr:
+		x, ok := expr.X.(*ast.Ident)
+		if !ok {
+			return nil
 		}
-	case *ast.BinaryExpr:
-		if e.Op == token.ADD {
-			return exprIsString(e.X) || exprIsString(e.Y)
+		return &ast.SelectorExpr{
+			X:   c.copyType(x).(*ast.Ident),
+			Sel: c.copyType(expr.Sel).(*ast.Ident),
 		}
-		return false
 	case *ast.ParenExpr:
-		return exprIsString(e.X)
+		return c.copyType(expr.X)
 	}
-	return false
+	return nil
 }
@@ -0,0 +1,384 @@
+package strings
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	"mvdan.cc/garble/hashing"
+)
+
+// ObfuscateLiterals replaces the string, integer, float, boolean and []byte
+// literals in a file with expressions which work them out at run time, so
+// that strings, magic numbers and key material don't show up in the binary as
+// is.
+//
+// Each string becomes a call to a decoder, using one of the named
+// obfuscators, or any of them if names is empty. Numbers are xored with a key
+// from a slice under keysName. Reading the keys from a variable stops the
+// compiler from folding the expressions back into constants.
+//
+// The choices and keys are derived from the salt, the package path, and the
+// position of each literal in the file.
+//
+// Only constant expressions made of literals are replaced, and only where a
+// constant isn't required: const declarations, array lengths, struct tags and
+// the indexes of array and slice literals are left alone. The type recorded
+// by the type checker is kept, so untyped constants still get the type their
+// context gives them, including named string types.
+//
+// Declarations and specs in skip, such as those with a //garble:nostrings
+// directive, are left alone.
+//
+// It must run before the file is renamed, as it adds identifiers. The returned
+// declarations, for the keys and the decoders, are to be added to the file
+// after it has been renamed.
+func ObfuscateLiterals(file *ast.File, fileName string, info *types.Info, pkg *types.Package, salt string, names []string, skip map[ast.Node]bool) ([]ast.Decl, error) {
+	enabled, err := enabledObfuscators(names)
+	if err != nil {
+		return nil, err
+	}
+	keysName := hashing.HashWith(salt, "literal keys "+fileName)
+	o := &literalObfuscator{
+		info:     info,
+		pkg:      pkg,
+		file:     file,
+		fileName: fileName,
+		salt:     salt,
+		keysName: keysName,
+		enabled:  enabled,
+		skip:     make(map[ast.Node]bool, len(skip)),
+		decoders: make(map[string]string),
+	}
+	for node := range skip {
+		o.skip[node] = true
+	}
+	setRand := func(node ast.Node) {
+		o.rnd = newRand(salt, pkg.Path(), fileName, int(node.Pos()-file.Pos()))
+	}
+
+	pre := func(cursor *astutil.Cursor) bool {
+		node := cursor.Node()
+		if o.skip[node] {
+			return false
+		}
+		switch node := node.(type) {
+		case *ast.GenDecl:
+			if node.Tok == token.CONST || node.Tok == token.IMPORT {
+				return false
+			}
+		case *ast.ArrayType:
+			return false // the length must be constant
+		case *ast.Field:
+			if node.Tag != nil {
+				o.skip[node.Tag] = true
+			}
+		case *ast.KeyValueExpr:
+			if lit, ok := cursor.Parent().(*ast.CompositeLit); ok && o.indexed(lit) {
+				o.skip[node.Key] = true
+			}
+		case *ast.CompositeLit:
+			setRand(node)
+			if repl := o.byteSlice(node); repl != nil {
+				setPositions(repl, node.Pos())
+				cursor.Replace(repl)
+				return false
+			}
+		case ast.Expr:
+			tv, ok := info.Types[node]
+			if !ok || tv.Value == nil {
+				return true
+			}
+			// The first constant found is the largest one. Its
+			// parts can't be replaced on their own, as they may
+			// only make sense when evaluated as a constant.
+			setRand(node)
+			if repl := o.constant(node, tv); repl != nil {
+				setPositions(repl, node.Pos())
+				cursor.Replace(repl)
+			}
+			return false
+		}
+		return true
+	}
+	astutil.Apply(file, pre, nil)
+
+	decls := o.decoderDecls()
+	if len(o.values) == 0 {
+		return decls, nil
+	}
+	keys := &ast.CompositeLit{Type: &ast.ArrayType{Elt: ast.NewIdent("uint64")}}
+	for _, key := range o.values {
+		keys.Elts = append(keys.Elts, uintLit(key))
+	}
+	decls = append(decls, &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{
+			Names:  []*ast.Ident{ast.NewIdent(keysName)},
+			Values: []ast.Expr{keys},
+		}},
+	})
+	return decls, nil
+}
+
+type literalObfuscator struct {
+	info     *types.Info
+	pkg      *types.Package
+	file     *ast.File
+	fileName string
+	salt     string
+	keysName string
+	enabled  []string
+	skip     map[ast.Node]bool
+
+	// decoders holds the name of the decoder for each obfuscator used
+	decoders map[string]string
+
+	// rnd is the randomness for the literal being obfuscated
+	rnd *rand.Rand
+
+	values []uint64
+}
+
+// indexed returns whether a composite literal is of an array or slice, whose
+// keys must be constant.
+func (o *literalObfuscator) indexed(lit *ast.CompositeLit) bool {
+	tv, ok := o.info.Types[lit]
+	if !ok {
+		return false
+	}
+	switch tv.Type.Underlying().(type) {
+	case *types.Array, *types.Slice:
+		return true
+	}
+	return false
+}
+
+// newKey adds a random key, and returns the expression which reads it.
+func (o *literalObfuscator) newKey() (uint64, ast.Expr) {
+	key := o.rnd.Uint64()
+	o.values = append(o.values, key)
+	return key, &ast.IndexExpr{
+		X:     ast.NewIdent(o.keysName),
+		Index: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(len(o.values) - 1)},
+	}
+}
+
+// decoded returns an expression which evaluates to value at run time.
+func (o *literalObfuscator) decoded(value uint64) ast.Expr {
+	key, keyExpr := o.newKey()
+	return &ast.BinaryExpr{X: uintLit(value ^ key), Op: token.XOR, Y: keyExpr}
+}
+
+// typeName returns the name of a basic type, if it isn't shadowed where the
+// literal is.
+func (o *literalObfuscator) typeName(t *types.Basic, pos token.Pos) (*ast.Ident, bool) {
+	name := t.Name()
+	if scope := o.pkg.Scope().Innermost(pos); scope != nil {
+		if _, obj := scope.LookupParent(name, pos); obj != types.Universe.Lookup(name) {
+			return nil, false
+		}
+	}
+	return ast.NewIdent(name), true
+}
+
+// constant returns the replacement for a constant expression, or nil if it
+// can't be replaced.
+func (o *literalObfuscator) constant(expr ast.Expr, tv types.TypeAndValue) ast.Expr {
+	if !o.literal(expr) {
+		return nil
+	}
+	if basic, ok := tv.Type.Underlying().(*types.Basic); ok && basic.Info()&types.IsString != 0 {
+		return o.stringConstant(expr, tv)
+	}
+	basic, ok := tv.Type.(*types.Basic)
+	if !ok {
+		return nil // named types, and type parameters
+	}
+	info := basic.Info()
+	if info&types.IsBoolean != 0 {
+		// Untyped booleans can stay untyped, as comparisons are.
+		bit := uint64(0)
+		if constant.BoolVal(tv.Value) {
+			bit = 1
+		}
+		return &ast.ParenExpr{X: &ast.BinaryExpr{
+			X:  o.decoded(bit),
+			Op: token.EQL,
+			Y:  uintLit(1),
+		}}
+	}
+	if info&types.IsUntyped != 0 || info&types.IsComplex != 0 {
+		return nil
+	}
+	name, ok := o.typeName(basic, expr.Pos())
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case info&types.IsInteger != 0:
+		var value uint64
+		if info&types.IsUnsigned != 0 {
+			value, _ = constant.Uint64Val(tv.Value)
+		} else {
+			signed, _ := constant.Int64Val(tv.Value)
+			value = uint64(signed)
+		}
+		// The conversion truncates to the type's size, so a signed
+		// value comes back with the same sign.
+		return &ast.CallExpr{Fun: name, Args: []ast.Expr{o.decoded(value)}}
+	case info&types.IsFloat != 0:
+		// A float is m * 2^exp, with m an integer. That way we only
+		// need to hide an integer, and scaling by a power of two is
+		// always exact.
+		f, _ := constant.Float64Val(tv.Value)
+		frac, exp := math.Frexp(f)
+		m := int64(frac * (1 << 53))
+		exp -= 53
+		for m != 0 && m%2 == 0 {
+			m /= 2
+			exp++
+		}
+		if m == 0 {
+			exp = 0
+		}
+		maxExp := 1023
+		if basic.Kind() == types.Float32 {
+			maxExp = 127
+		}
+		if exp > maxExp || -exp > maxExp {
+			return nil
+		}
+		int64Name, ok := o.typeName(types.Typ[types.Int64], expr.Pos())
+		if !ok {
+			return nil
+		}
+		var repl ast.Expr = &ast.CallExpr{Fun: name, Args: []ast.Expr{
+			&ast.CallExpr{Fun: int64Name, Args: []ast.Expr{o.decoded(uint64(m))}},
+		}}
+		if exp == 0 {
+			return repl
+		}
+		op, shift := token.MUL, exp
+		if exp < 0 {
+			op, shift = token.QUO, -exp
+		}
+		scale := &ast.ParenExpr{X: &ast.BinaryExpr{
+			X:  &ast.BasicLit{Kind: token.INT, Value: "1"},
+			Op: token.SHL,
+			Y:  &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(shift)},
+		}}
+		return &ast.ParenExpr{X: &ast.BinaryExpr{X: repl, Op: op, Y: scale}}
+	}
+	return nil
+}
+
+// stringConstant returns the replacement for a string constant expression, or
+// nil if it can't be replaced.
+func (o *literalObfuscator) stringConstant(expr ast.Expr, tv types.TypeAndValue) ast.Expr {
+	s := constant.StringVal(tv.Value)
+	if s == "" {
+		return nil
+	}
+	switch typ := tv.Type.(type) {
+	case *types.Basic:
+		// Outside const declarations, an untyped string is only left
+		// as such where it becomes a string anyway, like the values
+		// of the constants turned into variables.
+		if typ.Kind() == types.String || typ.Kind() == types.UntypedString {
+			return o.obfuscateString(s)
+		}
+	case *types.Named:
+		name := o.typeExpr(typ, expr.Pos())
+		if name == nil {
+			return nil
+		}
+		return &ast.CallExpr{Fun: name, Args: []ast.Expr{o.obfuscateString(s)}}
+	}
+	return nil
+}
+
+// literal returns whether a constant expression is made of literals only,
+// rather than of named constants, iota, or builtins like len.
+func (o *literalObfuscator) literal(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		obj := o.info.Uses[expr]
+		return obj != nil && (obj == types.Universe.Lookup("true") || obj == types.Universe.Lookup("false"))
+	case *ast.ParenExpr:
+		return o.literal(expr.X)
+	case *ast.UnaryExpr:
+		return o.literal(expr.X)
+	case *ast.BinaryExpr:
+		return o.literal(expr.X) && o.literal(expr.Y)
+	case *ast.CallExpr:
+		// conversions like uint8(200)
+		tv, ok := o.info.Types[expr.Fun]
+		if !ok || !tv.IsType() || len(expr.Args) != 1 {
+			return false
+		}
+		if _, ok := tv.Type.(*types.Basic); !ok {
+			return false
+		}
+		return o.literal(expr.Args[0])
+	}
+	return false
+}
+
+// byteSlice returns the replacement for a []byte literal with only constant
+// elements, or nil if it can't be replaced. Each key hides eight bytes.
+func (o *literalObfuscator) byteSlice(lit *ast.CompositeLit) ast.Expr {
+	tv, ok := o.info.Types[lit]
+	if !ok || len(lit.Elts) == 0 {
+		return nil
+	}
+	slice, ok := tv.Type.(*types.Slice)
+	if !ok || !types.Identical(slice.Elem(), types.Typ[types.Byte]) {
+		return nil
+	}
+	var values []byte
+	for _, elt := range lit.Elts {
+		etv, ok := o.info.Types[elt]
+		if !ok || etv.Value == nil {
+			return nil // also covers keyed elements
+		}
+		value, _ := constant.Uint64Val(etv.Value)
+		values = append(values, byte(value))
+	}
+	byteName, ok := o.typeName(types.Typ[types.Byte], lit.Pos())
+	if !ok {
+		return nil
+	}
+
+	repl := &ast.CompositeLit{Type: &ast.ArrayType{Elt: byteName}}
+	var key uint64
+	var keyExpr ast.Expr
+	for i, value := range values {
+		shift := uint(i%8) * 8
+		if shift == 0 {
+			key, keyExpr = o.newKey()
+		}
+		masked := &ast.BinaryExpr{
+			X:  keyExpr,
+			Op: token.SHR,
+			Y:  &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(int(shift))},
+		}
+		repl.Elts = append(repl.Elts, &ast.CallExpr{Fun: ast.NewIdent(byteName.Name), Args: []ast.Expr{
+			&ast.BinaryExpr{X: masked, Op: token.XOR, Y: uintLit(uint64(value ^ byte(key>>shift)))},
+		}})
+	}
+	return repl
+}
+
+func uintLit(n uint64) *ast.BasicLit {
+	return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatUint(n, 10)}
+}
@@ -0,0 +1,211 @@
+package strings
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// obfuscator turns the bytes of a string literal into the arguments of a
+// decoder func, which gives the string back at run time. Having a few of
+// them, picked at random for each literal, means that no single pattern
+// recovers every string in a binary.
+type obfuscator interface {
+	// obfuscate returns the arguments to the decoder which give back data.
+	// They are all literals, so the call fits where the string literal
+	// was, without adding any lines.
+	obfuscate(rnd *rand.Rand, data []byte) []ast.Expr
+
+	// decoder returns the source of the decoder func called name, which
+	// is added once to each file using it.
+	decoder(name string) string
+}
+
+var obfuscators = map[string]obfuscator{
+	"xor":      xorObfuscator{},
+	"shuffle":  shuffleObfuscator{},
+	"split":    splitObfuscator{},
+	"feedback": feedbackObfuscator{},
+	"aes":      aesObfuscator{},
+}
+
+// ObfuscatorNames returns the names of all the string obfuscators, sorted.
+func ObfuscatorNames() []string {
+	var names []string
+	for name := range obfuscators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quoteBytes returns a string literal with every byte escaped, so that none of
+// them show up in the source as is.
+func quoteBytes(data []byte) *ast.BasicLit {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, b := range data {
+		fmt.Fprintf(&buf, "\\x%02x", b)
+	}
+	buf.WriteByte('"')
+	return &ast.BasicLit{Kind: token.STRING, Value: buf.String()}
+}
+
+func intLit(n int) *ast.BasicLit {
+	return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+}
+
+func randomBytes(rnd *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+// xorObfuscator xors the data with a random mask of the same length.
+type xorObfuscator struct{}
+
+func (xorObfuscator) obfuscate(rnd *rand.Rand, data []byte) []ast.Expr {
+	mask := randomBytes(rnd, len(data))
+	masked := make([]byte, len(data))
+	for i, b := range data {
+		masked[i] = b ^ mask[i]
+	}
+	return []ast.Expr{quoteBytes(mask), quoteBytes(masked)}
+}
+
+func (xorObfuscator) decoder(name string) string {
+	return fmt.Sprintf(`func %s(mask, masked string) string {
+	data := []byte(masked)
+	for i := range data {
+		data[i] ^= mask[i]
+	}
+	return string(data)
+}`, name)
+}
+
+// shuffleObfuscator puts the data in a random order, xored with a single byte,
+// along with the table of indexes which puts it back in place. Each index
+// takes four bytes.
+type shuffleObfuscator struct{}
+
+func (shuffleObfuscator) obfuscate(rnd *rand.Rand, data []byte) []ast.Expr {
+	key := byte(rnd.Intn(256))
+	perm := rnd.Perm(len(data))
+	shuffled := make([]byte, len(data))
+	var index []byte
+	for i, j := range perm {
+		shuffled[j] = data[i] ^ key
+		index = append(index, byte(j>>24), byte(j>>16), byte(j>>8), byte(j))
+	}
+	return []ast.Expr{quoteBytes(shuffled), quoteBytes(index), intLit(int(key))}
+}
+
+func (shuffleObfuscator) decoder(name string) string {
+	return fmt.Sprintf(`func %s(shuffled, index string, key byte) string {
+	data := make([]byte, len(shuffled))
+	for i := range data {
+		j := int(index[i*4])<<24 | int(index[i*4+1])<<16 | int(index[i*4+2])<<8 | int(index[i*4+3])
+		data[i] = shuffled[j] ^ key
+	}
+	return string(data)
+}`, name)
+}
+
+// splitObfuscator splits the data into a few chunks, each xored with its own
+// byte, and appends them back together.
+type splitObfuscator struct{}
+
+func (splitObfuscator) obfuscate(rnd *rand.Rand, data []byte) []ast.Expr {
+	var keys []byte
+	var chunks []ast.Expr
+	for len(data) > 0 {
+		n := 1 + rnd.Intn(len(data))
+		if n > 16 {
+			n = 1 + rnd.Intn(16)
+		}
+		key := byte(rnd.Intn(256))
+		chunk := make([]byte, n)
+		for i := range chunk {
+			chunk[i] = data[i] ^ key
+		}
+		keys = append(keys, key)
+		chunks = append(chunks, quoteBytes(chunk))
+		data = data[n:]
+	}
+	return append([]ast.Expr{quoteBytes(keys)}, chunks...)
+}
+
+func (splitObfuscator) decoder(name string) string {
+	return fmt.Sprintf(`func %s(keys string, chunks ...string) string {
+	var data []byte
+	for i, chunk := range chunks {
+		for j := 0; j < len(chunk); j++ {
+			data = append(data, chunk[j]^keys[i])
+		}
+	}
+	return string(data)
+}`, name)
+}
+
+// feedbackObfuscator xors each byte with a state which starts at a random
+// seed, and is updated with each byte that has been decoded, so that the
+// same character is encoded differently each time.
+type feedbackObfuscator struct{}
+
+func (feedbackObfuscator) obfuscate(rnd *rand.Rand, data []byte) []ast.Expr {
+	seed := byte(rnd.Intn(256))
+	mul := byte(rnd.Intn(128))*2 + 1
+	add := byte(rnd.Intn(256))
+	encoded := make([]byte, len(data))
+	state := seed
+	for i, b := range data {
+		encoded[i] = b ^ state
+		state = state*mul + b + add
+	}
+	return []ast.Expr{quoteBytes(encoded), intLit(int(seed)), intLit(int(mul)), intLit(int(add))}
+}
+
+func (feedbackObfuscator) decoder(name string) string {
+	return fmt.Sprintf(`func %s(encoded string, state, mul, add byte) string {
+	data := make([]byte, len(encoded))
+	for i := range data {
+		data[i] = encoded[i] ^ state
+		state = state*mul + data[i] + add
+	}
+	return string(data)
+}`, name)
+}
+
+// aesObfuscator encrypts the data with AES-128 in CTR mode. The key is split
+// into two random shares which are xored together at run time. The decoder
+// has its own AES, since the package might not import crypto/aes.
+type aesObfuscator struct{}
+
+func (aesObfuscator) obfuscate(rnd *rand.Rand, data []byte) []ast.Expr {
+	key := randomBytes(rnd, 16)
+	iv := randomBytes(rnd, 16)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // the key is always 16 bytes
+	}
+	encrypted := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(encrypted, data)
+
+	keyMask := randomBytes(rnd, 16)
+	maskedKey := make([]byte, 16)
+	for i := range key {
+		maskedKey[i] = key[i] ^ keyMask[i]
+	}
+	return []ast.Expr{quoteBytes(maskedKey), quoteBytes(keyMask), quoteBytes(iv), quoteBytes(encrypted)}
+}
+
+func (aesObfuscator) decoder(name string) string {
+	sbox := aesSbox()
+	return fmt.Sprintf(aesDecoder, name, quoteBytes(sbox[:]).Value)
+}
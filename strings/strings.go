@@ -1,154 +1,151 @@
 package strings
 
 import (
-	"bytes"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
-	"io/ioutil"
-	"math/rand"
-	"os"
-	"path/filepath"
+	"go/types"
+	"reflect"
 	"sort"
-	"strconv"
+
+	"mvdan.cc/garble/hashing"
 )
 
-func ObfuscateStrings(path string) error {
-	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() || !isGoFile(path) {
-			return nil
-		}
-		if err := stringConstsToVar(path); err != nil {
-			return err
+// enabledObfuscators returns the string obfuscators with the given names, or
+// all of them if names is empty, sorted by name.
+func enabledObfuscators(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return ObfuscatorNames(), nil
+	}
+	for _, name := range names {
+		if _, ok := obfuscators[name]; !ok {
+			return nil, fmt.Errorf("unknown string obfuscator %q", name)
 		}
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return names, nil
+}
 
-		contents, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
+// obfuscateString returns a call which gives back s at run time, using one
+// of the enabled obfuscators picked at random.
+func (o *literalObfuscator) obfuscateString(s string) ast.Expr {
+	name := o.enabled[o.rnd.Intn(len(o.enabled))]
+	decoder, ok := o.decoders[name]
+	if !ok {
+		decoder = hashing.HashWith(o.salt, "string decoder "+name+" "+o.fileName)
+		o.decoders[name] = decoder
+	}
+	return &ast.CallExpr{
+		Fun:  ast.NewIdent(decoder),
+		Args: obfuscators[name].obfuscate(o.rnd, []byte(s)),
+	}
+}
 
-		set := token.NewFileSet()
-		file, err := parser.ParseFile(set, path, contents, 0)
+// decoderDecls returns the decoders used in the file, sorted by obfuscator
+// name so that the output is the same with the same salt.
+func (o *literalObfuscator) decoderDecls() []ast.Decl {
+	var names []string
+	for name := range o.decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var decls []ast.Decl
+	for _, name := range names {
+		src := "package p\n\n" + obfuscators[name].decoder(o.decoders[name])
+		file, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
 		if err != nil {
-			return nil
+			panic(err) // the decoders are ours, so they always parse
 		}
+		decl := file.Decls[0]
+		clearPositions(decl)
+		decls = append(decls, decl)
+	}
+	return decls
+}
 
-		obfuscator := &stringObfuscator{Contents: contents}
-		for _, decl := range file.Decls {
-			ast.Walk(obfuscator, decl)
+// clearPositions sets every position in a node parsed on its own to NoPos, as
+// they would mean nothing in the file set of the package being compiled.
+func clearPositions(node ast.Node) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node == nil {
+			return false
 		}
-		newCode, err := obfuscator.Obfuscate()
-		if err != nil {
-			return err
+		v := reflect.ValueOf(node).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Field(i); field.Type() == posType {
+				field.SetInt(0)
+			}
 		}
-		return ioutil.WriteFile(path, newCode, 0755)
+		return true
 	})
 }
 
-type stringObfuscator struct {
-	Contents []byte
-	Nodes    []*ast.BasicLit
+// setPositions places the new nodes of a replacement where the literal it
+// replaces was. Without positions, the printer could move the comments after
+// it, such as a //go:noinline, into the middle of the replacement. A call's
+// Ellipsis is left alone, as it's only set for calls like f(args...).
+func setPositions(node ast.Node, pos token.Pos) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node == nil {
+			return false
+		}
+		v := reflect.ValueOf(node).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).Name == "Ellipsis" {
+				continue
+			}
+			if field := v.Field(i); field.Type() == posType && field.Int() == 0 {
+				field.SetInt(int64(pos))
+			}
+		}
+		return true
+	})
 }
 
-func (s *stringObfuscator) Visit(n ast.Node) ast.Visitor {
-	if lit, ok := n.(*ast.BasicLit); ok {
-		if lit.Kind == token.STRING {
-			s.Nodes = append(s.Nodes, lit)
-		}
+// typeExpr returns an expression naming a named string type where the
+// literal at pos is, or nil if it can't be named there. The new identifiers
+// are recorded, so that they're renamed like the original ones.
+func (o *literalObfuscator) typeExpr(named *types.Named, pos token.Pos) ast.Expr {
+	obj := named.Obj()
+	if obj.Pkg() == nil || named.TypeArgs().Len() > 0 {
 		return nil
-	} else if decl, ok := n.(*ast.GenDecl); ok {
-		if decl.Tok == token.CONST || decl.Tok == token.IMPORT {
-			return nil
-		}
-	} else if _, ok := n.(*ast.StructType); ok {
-		// Avoid messing with annotation strings.
+	}
+	scope := o.pkg.Scope().Innermost(pos)
+	if scope == nil {
 		return nil
 	}
-	return s
-}
-
-func (s *stringObfuscator) Obfuscate() ([]byte, error) {
-	sort.Sort(s)
-
-	parsed := make([]string, s.Len())
-	for i, n := range s.Nodes {
-		var err error
-		parsed[i], err = strconv.Unquote(n.Value)
-		if err != nil {
-			return nil, err
+	if obj.Pkg() == o.pkg {
+		if _, found := scope.LookupParent(obj.Name(), pos); found != obj {
+			return nil // declared in a function, or shadowed
 		}
+		id := ast.NewIdent(obj.Name())
+		o.info.Uses[id] = obj
+		return id
 	}
-
-	var lastIndex int
-	var result bytes.Buffer
-	data := s.Contents
-	for i, node := range s.Nodes {
-		strVal := parsed[i]
-		startIdx := node.Pos() - 1
-		endIdx := node.End() - 1
-		result.Write(data[lastIndex:startIdx])
-		result.Write(obfuscatedStringCode(strVal))
-		lastIndex = int(endIdx)
+	if !obj.Exported() {
+		return nil
 	}
-	result.Write(data[lastIndex:])
-	return result.Bytes(), nil
-}
-
-func (s *stringObfuscator) Len() int {
-	return len(s.Nodes)
-}
-
-func (s *stringObfuscator) Swap(i, j int) {
-	s.Nodes[i], s.Nodes[j] = s.Nodes[j], s.Nodes[i]
-}
-
-func (s *stringObfuscator) Less(i, j int) bool {
-	return s.Nodes[i].Pos() < s.Nodes[j].Pos()
-}
-
-// func obfuscatedStringCode(str string) []byte {
-// 	var res bytes.Buffer
-// 	res.WriteString("(func() string {\n")
-// 	res.WriteString("mask := []byte(\"")
-// 	mask := make([]byte, len(str))
-// 	for i := range mask {
-// 		mask[i] = byte(rand.Intn(256))
-// 		res.WriteString(fmt.Sprintf("\\x%02x", mask[i]))
-// 	}
-// 	res.WriteString("\")\nmaskedStr := []byte(\"")
-// 	for i, x := range []byte(str) {
-// 		res.WriteString(fmt.Sprintf("\\x%02x", x^mask[i]))
-// 	}
-// 	res.WriteString("\")\nres := make([]byte, ")
-// 	res.WriteString(strconv.Itoa(len(mask)))
-// 	res.WriteString(`)
-//         for i, m := range mask {
-//             res[i] = m ^ maskedStr[i]
-//         }
-//         return string(res)
-//         }())`)
-// 	return res.Bytes()
-// }
-
-func obfuscatedStringCode(str string) []byte {
-	var res bytes.Buffer
-	res.WriteString("(func() string {mask := []byte(\"")
-
-	mask := make([]byte, len(str))
-	for i := range mask {
-		mask[i] = byte(rand.Intn(256))
-		res.WriteString(fmt.Sprintf("\\x%02x", mask[i]))
+	fileScope := o.info.Scopes[o.file]
+	if fileScope == nil {
+		return nil
 	}
-	res.WriteString("\"); maskedStr := []byte(\"")
-	for i, x := range []byte(str) {
-		res.WriteString(fmt.Sprintf("\\x%02x", x^mask[i]))
+	for _, name := range fileScope.Names() {
+		pkgName, ok := fileScope.Lookup(name).(*types.PkgName)
+		if !ok || pkgName.Imported() != obj.Pkg() || name == "." || name == "_" {
+			continue
+		}
+		if _, found := scope.LookupParent(name, pos); found != pkgName {
+			continue
+		}
+		x := ast.NewIdent(name)
+		o.info.Uses[x] = pkgName
+		sel := ast.NewIdent(obj.Name())
+		o.info.Uses[sel] = obj
+		return &ast.SelectorExpr{X: x, Sel: sel}
 	}
-	res.WriteString("\"); res := make([]byte, ")
-	res.WriteString(strconv.Itoa(len(mask)))
-	res.WriteString("); for i, m := range mask { res[i] = m ^ maskedStr[i]}; return string(res)}())")
-	return res.Bytes()
-}
\ No newline at end of file
+	return nil
+}
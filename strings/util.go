@@ -1,21 +1,16 @@
 package strings
 
 import (
-	"path/filepath"
+	"fmt"
 	"math/rand"
+
+	"mvdan.cc/garble/hashing"
 )
 
-func isGoFile(path string) bool {
-	return filepath.Ext(path) == ".go"
+// newRand returns the randomness for obfuscating whatever is at offset in a
+// file, derived from the salt, so that builds with the same salt make the same
+// choices, and each literal makes its own.
+func newRand(salt, pkgPath, file string, offset int) *rand.Rand {
+	seed := hashing.SeedWith(salt, fmt.Sprintf("%s/%s:%d", pkgPath, file, offset))
+	return rand.New(rand.NewSource(seed))
 }
-
-func randomString(length int) string {
-
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-
-	b := make([]rune, length)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
-}
\ No newline at end of file
@@ -0,0 +1,204 @@
+// Package symbolmap describes the map file written by 'garble build', which
+// records every hashed identifier and file name along with its original name.
+// It allows 'garble ungarble' to work without access to the original source.
+package symbolmap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kind is the kind of object that was hashed.
+type Kind string
+
+const (
+	KindFile    Kind = "file"
+	KindFunc    Kind = "func"
+	KindMethod  Kind = "method"
+	KindType    Kind = "type"
+	KindVar     Kind = "var"
+	KindConst   Kind = "const"
+	KindField   Kind = "field"
+	KindPackage Kind = "package"
+)
+
+// Entry is a single hashed name.
+type Entry struct {
+	Original string `json:"original"`
+	Hash     string `json:"hash"`
+	Package  string `json:"package"`
+	Kind     Kind   `json:"kind"`
+
+	// Position is the position of the original declaration, in the form
+	// "file.go:line:column". The file is relative to the directory
+	// 'garble build' was run from, if possible.
+	Position string `json:"position,omitempty"`
+}
+
+// Map is the contents of a map file.
+type Map struct {
+	Entries []Entry `json:"entries"`
+
+	// Lines is only filled when line numbers were obfuscated.
+	Lines []LineTable `json:"lines,omitempty"`
+}
+
+// LineTable maps the line numbers of a garbled file back to the original ones.
+type LineTable struct {
+	Package  string      `json:"package"`
+	File     string      `json:"file"` // the hashed name, without the .go extension
+	Original string      `json:"original"`
+	Blocks   []LineBlock `json:"blocks"`
+}
+
+// LineBlock is a range of consecutive lines in a garbled file.
+type LineBlock struct {
+	Start int `json:"start"`
+
+	// Lines holds the original line for each garbled line, starting at Start.
+	Lines []int `json:"lines"`
+}
+
+// OriginalLine returns the original line for a line in the garbled file.
+func (t *LineTable) OriginalLine(line int) (int, bool) {
+	for _, block := range t.Blocks {
+		if i := line - block.Start; i >= 0 && i < len(block.Lines) {
+			return block.Lines[i], true
+		}
+	}
+	return 0, false
+}
+
+// Read loads a map file written by Write.
+func Read(path string) (*Map, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Map
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode map file %s", path)
+	}
+	return &m, nil
+}
+
+// Write writes the map to path as JSON. The entries are sorted first, so that
+// the same build produces the same map file.
+func (m *Map) Write(path string) error {
+	sort.Slice(m.Entries, func(i, j int) bool {
+		a, b := m.Entries[i], m.Entries[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Original != b.Original {
+			return a.Original < b.Original
+		}
+		return a.Position < b.Position
+	})
+	sort.Slice(m.Lines, func(i, j int) bool {
+		a, b := m.Lines[i], m.Lines[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.File < b.File
+	})
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// WriteFragment writes the map for a single package into dir. Each compiler
+// invocation runs in its own process, so every package writes its own
+// fragment, and MergeFragments joins the ones in a build once it's done.
+//
+// Fragments stay in dir after the build, as packages pulled from the build
+// cache don't write them again, so they are encrypted with a key derived from
+// the salt. Without the salt, they reveal no more than the binary does.
+func WriteFragment(dir, name, salt string, fragment *Map) error {
+	data, err := json.Marshal(fragment)
+	if err != nil {
+		return err
+	}
+	aead, err := fragmentAEAD(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data = aead.Seal(nonce, nonce, data, []byte(name))
+	return ioutil.WriteFile(filepath.Join(dir, name+".bin"), data, 0600)
+}
+
+// fragmentMtimeInterval is how often the mtime of a used fragment is updated,
+// like the go build cache does for its entries, so that unused fragments can
+// be trimmed.
+const fragmentMtimeInterval = time.Hour
+
+// MergeFragments reads the fragments with the given names from dir into a
+// single map. Missing fragments are skipped, as not every package writes one.
+// The mtime of each fragment read is updated at most once an hour, to record
+// that it's still in use.
+func MergeFragments(dir, salt string, names []string) (*Map, error) {
+	aead, err := fragmentAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	var m Map
+	for _, name := range names {
+		path := filepath.Join(dir, name+".bin")
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, errors.Errorf("Map fragment %s is truncated", path)
+		}
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if data, err = aead.Open(nil, nonce, ciphertext, []byte(name)); err != nil {
+			return nil, errors.Wrapf(err, "Could not decrypt map fragment %s", path)
+		}
+		var fragment Map
+		if err := json.Unmarshal(data, &fragment); err != nil {
+			return nil, errors.Wrapf(err, "Could not decode map fragment %s", path)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > fragmentMtimeInterval {
+			now := time.Now()
+			os.Chtimes(path, now, now) // only a hint; ignore errors
+		}
+		m.Entries = append(m.Entries, fragment.Entries...)
+		m.Lines = append(m.Lines, fragment.Lines...)
+	}
+	return &m, nil
+}
+
+// fragmentAEAD returns the AES-GCM cipher for the fragments of builds with
+// the given salt.
+func fragmentAEAD(salt string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte("garble symbol map fragment"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,43 +1,72 @@
 package ungarble
 
 import (
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 	"golang.org/x/tools/go/ast/astutil"
-	"go/types"
-	"mvdan.cc/garble/hashing"
-	"strings"
 
-	//"golang.org/x/tools/go/ast/astutil"
-	"go/parser"
-	"go/ast"
-	"path/filepath"
-	"os"
-	"log"
+	"mvdan.cc/garble/hashing"
+	"mvdan.cc/garble/symbolmap"
 )
 
 // remember to add .go to filenames before hashing when trying to find in map
 
 type fileInfo struct {
-	name string
-	path string
-	file *ast.File
+	name      string
+	path      string
+	file      *ast.File
 	typesInfo *types.Info
 }
 
 // The key will be the hash sha256(pacakge name + file name)
-var hashToFileInfo =  make(map[string]fileInfo)
+var hashToFileInfo = make(map[string]fileInfo)
 
-// key is hash, value is original method or function name.
-// just used as a cache
-var hashToIdentifierCache =  make(map[string]string)
+// The key is the hashed file name, when line numbers were obfuscated.
+var hashToLineTable = make(map[string]*symbolmap.LineTable)
+
+// key is hash, value is all the original identifier names which hash to it.
+// There is usually only one, but different names can collide.
+var hashToIdentifierCache = make(map[string][]string)
+
+// cacheIdentifier records that name was hashed to hashed.
+func cacheIdentifier(hashed, name string) {
+	for _, original := range hashToIdentifierCache[hashed] {
+		if original == name {
+			return
+		}
+	}
+	hashToIdentifierCache[hashed] = append(hashToIdentifierCache[hashed], name)
+}
 
 // walk the given directory populating hashToFileInfo map
 func populateFileHashInfo(salt string) error {
 
-	var files []*ast.File
+	// files are grouped by package, so that they can be type-checked together
+	packages := make(map[string][]fileInfo)
+	var packageKeys []string
 
 	err := filepath.Walk(originalSourcePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// skip the same directories that the go tool ignores
+			name := info.Name()
+			if path != originalSourcePath && (name == "testdata" || name == "vendor" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
 		// make sure it's a go file
 		if !strings.HasSuffix(path, ".go") {
@@ -50,32 +79,115 @@ func populateFileHashInfo(salt string) error {
 			return errors.Wrap(err, "Err parsing file to *ast.File")
 		}
 
-		files = append(files, file)
+		key := filepath.Dir(path) + " " + file.Name.Name
+		if _, ok := packages[key]; !ok {
+			packageKeys = append(packageKeys, key)
+		}
+		packages[key] = append(packages[key], fileInfo{
+			name: info.Name(),
+			path: path,
+			file: file,
+		})
 
-		hashedFileName := hashing.HashFileName(salt, info.Name(), file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		typesInfo, err := getTypesInfo(path, file)
+	// --import-paths hashes the import path of each package, which we can
+	// work out from the module path
+	modPath, modDir := findModule(originalSourcePath)
+
+	for _, key := range packageKeys {
+		files := packages[key]
+
+		if modPath != "" {
+			dir := filepath.Dir(files[0].path)
+			if rel, err := filepath.Rel(modDir, dir); err == nil && !strings.HasPrefix(rel, "..") {
+				importPath := modPath
+				if rel != "." {
+					importPath += "/" + filepath.ToSlash(rel)
+				}
+				cacheIdentifier(hashing.HashWith(salt, importPath), importPath)
+			}
+		}
+
+		typesInfo, err := getTypesInfo(files)
 		if err != nil {
 			return err
 		}
 
-		hashToFileInfo[hashedFileName] = fileInfo{
-			info.Name(),
-			path,
-			file,
-			typesInfo,
-		}
+		for _, fileInfo := range files {
+			fileInfo.typesInfo = typesInfo
 
-		return nil
-	})
+			hashedFileName := hashing.HashFileName(salt, fileInfo.name, fileInfo.file)
+			hashToFileInfo[hashedFileName] = fileInfo
+
+			cacheIdentifiers(fileInfo, salt)
+		}
+	}
 
 	//log.Printf("%v", hashToFileInfo)
 
-	return err
+	return nil
+}
+
+// findModule returns the module path and root directory of the module
+// containing dir, or empty strings if there is none.
+func findModule(dir string) (string, string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", ""
+	}
+	for {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) == 2 && fields[0] == "module" {
+					return strings.Trim(fields[1], `"`), dir
+				}
+			}
+			return "", ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+// loadSymbolMap fills the same maps as populateFileHashInfo, but from the map
+// file written by 'garble build', so that no source or type checking is needed.
+func loadSymbolMap(path string) error {
+	symbolMap, err := symbolmap.Read(path)
+	if err != nil {
+		return err
+	}
+	useSymbolMap(symbolMap)
+	return nil
+}
+
+// useSymbolMap fills the maps from a symbol map which was already loaded.
+func useSymbolMap(symbolMap *symbolmap.Map) {
+	for _, entry := range symbolMap.Entries {
+		if entry.Kind == symbolmap.KindFile {
+			hashToFileInfo[entry.Hash] = fileInfo{name: entry.Original}
+			continue
+		}
+		cacheIdentifier(entry.Hash, entry.Original)
+	}
+
+	for i := range symbolMap.Lines {
+		table := &symbolMap.Lines[i]
+		hashToLineTable[table.File] = table
+	}
 }
 
 type garblePair struct {
-	hashed string   // the hashed version we pull from the log file
+	hashed   string // the hashed version we pull from the log file
 	original string // the original string before it was hashed.
 }
 
@@ -85,7 +197,8 @@ func getOriginalFileName(pair garblePair) garblePair {
 	}
 
 	if fileInfo, ok := hashToFileInfo[pair.hashed]; ok {
-		pair.original = fileInfo.name
+		// the hashed name was matched without its .go extension
+		pair.original = strings.TrimSuffix(fileInfo.name, ".go")
 		return pair
 	}
 
@@ -94,78 +207,60 @@ func getOriginalFileName(pair garblePair) garblePair {
 	return pair
 }
 
-func getOriginalMethodName(pair garblePair, hashedFileName, salt string) (garblePair, error) {
-	if pair.hashed == "" {
-		return pair, nil
+// getOriginalIdentifier returns the original name for a hashed identifier, or
+// the hashed name itself if it wasn't found, since it may never have been hashed.
+// If the hash is ambiguous, all the candidates are listed, like "{foo|bar}".
+func getOriginalIdentifier(hashed string) string {
+	originals := hashToIdentifierCache[hashed]
+	switch len(originals) {
+	case 0:
+	case 1:
+		return originals[0]
+	default:
+		return "{" + strings.Join(originals, "|") + "}"
 	}
 
-	// first check cache
-	if original, ok := hashToIdentifierCache[pair.hashed]; ok {
-		pair.original = original
-		return pair, nil
-	}
-
-	fileInfo, ok := hashToFileInfo[hashedFileName]
-	if !ok {
-		return pair, errors.New("Passed hashed filename was not found in map")
+	if os.Getenv("VERBOSE") == "true" {
+		log.Printf("Either failed to find original value for identifier with name: %s Or else "+
+			" it wasn't hashed in the first place", hashed)
 	}
 
-	originalIdentifier := findOriginalIdentifier(fileInfo, pair.hashed, salt)
-
-	pair.original = originalIdentifier
-
-	return pair, nil
+	return hashed
 }
 
-// Go through file and find function names.
-// Then hash the function name and put values in cache.
-// Return the identifier name if found
-func findOriginalIdentifier(fileInfo fileInfo, hashedName, salt string) string {
+// Go through file and find the names of types, consts, vars, fields and funcs,
+// which are the ones garble hashes.
+// Then hash the names and put values in cache.
+func cacheIdentifiers(fileInfo fileInfo, salt string) {
 
 	pre := func(cursor *astutil.Cursor) bool {
 
 		switch node := cursor.Node().(type) {
 
-			case *ast.Ident:
-
-				if node.Name == "_" {
-					return true // unnamed remains unnamed
-				}
+		case *ast.Ident:
 
-				if strings.HasPrefix(node.Name, "_C") || strings.Contains(node.Name, "_cgo") {
-					return true // don't mess with cgo-generated code
-				}
+			if node.Name == "_" {
+				return true // unnamed remains unnamed
+			}
 
-				obj := fileInfo.typesInfo.ObjectOf(node)
+			if strings.HasPrefix(node.Name, "_C") || strings.Contains(node.Name, "_cgo") {
+				return true // don't mess with cgo-generated code
+			}
 
-				switch x := obj.(type) {
+			obj := fileInfo.typesInfo.ObjectOf(node)
 
-					case *types.Func:
-						_ = x
-						funcName := node.Name
-						hashedName := hashing.HashWith(salt, funcName)
-						hashToIdentifierCache[hashedName] = funcName
-				}
+			switch obj.(type) {
 
-				return true
+			case *types.Func, *types.TypeName, *types.Var, *types.Const:
+				name := node.Name
+				cacheIdentifier(hashing.HashWith(salt, name), name)
 			}
 
-		return true
-	}
-
-	_  = astutil.Apply(fileInfo.file, pre, nil).(*ast.File)
-
-	if original, ok := hashToIdentifierCache[hashedName]; ok {
-		return original
-	}
+			return true
+		}
 
-	if os.Getenv("VERBOSE") == "true" {
-		log.Printf("Either failed to find original value for function with name: %s Or else " +
-			" it wasn't hashed in the first place", hashedName)
+		return true
 	}
 
-
-	// we didn't find it for some reason, so return the hashed version
-	// (it may be an identifier that was never hashed as well)
-	return hashedName
-}
\ No newline at end of file
+	_ = astutil.Apply(fileInfo.file, pre, nil).(*ast.File)
+}
@@ -0,0 +1,149 @@
+package ungarble
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// the header of each goroutine in a dump, like "goroutine 1 [running]:"
+	reGoroutine = regexp.MustCompile(`^goroutine \d+ \[[^\]]*\]:\s*$`)
+
+	// the position line that follows each frame, like "\tzAbc12345.go:21 +0x41"
+	reFileLine = regexp.MustCompile(`^\s+\S*\.go:\d+`)
+
+	// what follows the function name in a frame: the arguments, which are
+	// "(...)" for inlined frames, and the goroutine for "created by" lines
+	reFrameTail = regexp.MustCompile(`^(\(.*\))?( in goroutine \d+)?\s*$`)
+
+	// the file name and line in a position line
+	reFilenameLine = regexp.MustCompile(`[\s/]([a-zA-Z0-9_]+)\.go:(\d+)`)
+
+	// a name as produced by hashing.HashWith
+	reHashedName = regexp.MustCompile(`\b[zZ][a-zA-Z0-9_]{8}\b`)
+)
+
+const createdByPrefix = "created by "
+
+// frame is a function line in a stack trace, such as:
+//
+//	foo.com/pkg.(*zAbc12345).zDef67890(0xc000010000, 0x1)
+//	foo.com/pkg.zGhi12345.func1(...)
+//	created by foo.com/pkg.zJkl12345 in goroutine 1
+type frame struct {
+	prefix string // "created by ", if present
+	pkg    string // the import path, which is hashed with --import-paths
+
+	// symbol is everything after the package; the receiver type, the
+	// function or method name, and any closure or generic suffixes, like
+	// "(*zAbc12345).zDef67890.func1.2" or "zGhi12345[...]".
+	symbol string
+
+	tail string // the arguments and the rest of the line, kept as-is
+}
+
+// parseFrame parses a function line from a stack trace, returning false if
+// the line doesn't look like one.
+func parseFrame(line string) (frame, bool) {
+	var f frame
+	rest := line
+	if strings.HasPrefix(rest, createdByPrefix) {
+		f.prefix = createdByPrefix
+		rest = rest[len(createdByPrefix):]
+	}
+
+	end := symbolEnd(rest)
+	symbol := rest[:end]
+	f.tail = rest[end:]
+	if !reFrameTail.MatchString(f.tail) {
+		return frame{}, false
+	}
+
+	// The package path ends at the first dot after the last slash. The
+	// runtime escapes any dots in the last path element, so this is safe.
+	slash := strings.LastIndex(symbol, "/")
+	dot := strings.Index(symbol[slash+1:], ".")
+	if dot <= 0 {
+		return frame{}, false
+	}
+	dot += slash + 1
+	f.pkg, f.symbol = symbol[:dot], symbol[dot+1:]
+	if f.symbol == "" {
+		return frame{}, false
+	}
+	return f, true
+}
+
+// symbolEnd returns the index where the function symbol at the start of s
+// ends. Parentheses after a dot belong to a receiver like "(*T)", while any
+// other parenthesis starts the argument list.
+func symbolEnd(s string) int {
+	for i, r := range s {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return i
+		case '(':
+			if i == 0 || s[i-1] != '.' {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+// ungarble replaces all the hashed type, function and method names in the
+// frame with their original names, as well as the import path.
+func (f *frame) ungarble() {
+	if reHashedName.MatchString(f.pkg) {
+		f.pkg = getOriginalIdentifier(f.pkg)
+	}
+	f.symbol = reHashedName.ReplaceAllStringFunc(f.symbol, getOriginalIdentifier)
+}
+
+func (f frame) String() string {
+	return f.prefix + f.pkg + "." + f.symbol + f.tail
+}
+
+// ungarbleFrameLine ungarbles a function line, leaving any other line as-is.
+func ungarbleFrameLine(line string) string {
+	f, ok := parseFrame(line)
+	if !ok {
+		return line
+	}
+	f.ungarble()
+	return f.String()
+}
+
+// ungarbleFileLine replaces the hashed filename in a position line, as well
+// as the line number if it was obfuscated.
+func ungarbleFileLine(line string) string {
+	match := reFilenameLine.FindStringSubmatchIndex(line)
+	if match == nil {
+		return line
+	}
+	hashed := line[match[2]:match[3]]
+	lineNum := line[match[4]:match[5]]
+
+	fileNamePair := getOriginalFileName(garblePair{hashed: hashed})
+	if table, ok := hashToLineTable[hashed]; ok {
+		if n, err := strconv.Atoi(lineNum); err == nil {
+			if orig, ok := table.OriginalLine(n); ok && orig > 0 {
+				lineNum = strconv.Itoa(orig)
+			}
+		}
+	}
+	return line[:match[2]] + fileNamePair.original + ".go:" + lineNum + line[match[5]:]
+}
+
+// ungarbleAllNames replaces every hashed name in the line, wherever it
+// appears. Hashed file names are replaced too, such as those printed by
+// log.Lshortfile.
+func ungarbleAllNames(line string) string {
+	return reHashedName.ReplaceAllStringFunc(line, func(hashed string) string {
+		if _, ok := hashToFileInfo[hashed]; ok {
+			return getOriginalFileName(garblePair{hashed: hashed}).original
+		}
+		return getOriginalIdentifier(hashed)
+	})
+}
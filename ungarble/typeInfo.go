@@ -9,11 +9,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
-
-
-
 // origLookup helps implement a types.Importer which finds the export data for
 // the original dependencies, not their garbled counterparts. This is useful to
 // typecheck a package before it's garbled, so we can make decisions on how to
@@ -22,7 +20,7 @@ func origLookup(path string) (io.ReadCloser, error) {
 	cmd := exec.Command("go", "list", "-json", "-export", path)
 	//wd, _ := os.Getwd()
 	//if err != nil {
-		//return err
+	//return err
 	//}
 	cmd.Dir = originalSourcePath
 	out, err := cmd.CombinedOutput()
@@ -38,22 +36,30 @@ func origLookup(path string) (io.ReadCloser, error) {
 	return os.Open(res.Export)
 }
 
-// the pkgPath param is the import like you would use at the top of the file to import the package
-func getTypesInfo(filePath string, file *ast.File) (*types.Info, error) {
+// getTypesInfo type-checks all the files of a single package together, since
+// a file on its own will usually refer to declarations in its sibling files.
+func getTypesInfo(files []fileInfo) (*types.Info, error) {
 
 	info := &types.Info{
 		Defs: make(map[*ast.Ident]types.Object),
 		Uses: make(map[*ast.Ident]types.Object),
 	}
 
-	files := []*ast.File{file}
+	var astFiles []*ast.File
+	for _, file := range files {
+		astFiles = append(astFiles, file.file)
+	}
 
-	pkgImportPath, err := getPkgImportPathFromFilePath(filePath)
+	pkgImportPath, err := getPkgImportPathFromFilePath(files[0].path)
 	if err != nil {
 		return nil, err
 	}
+	if name := astFiles[0].Name.Name; strings.HasSuffix(name, "_test") {
+		// external test package, living next to the package it tests
+		pkgImportPath += "_test"
+	}
 
-	if _, err := origTypesConfig.Check(pkgImportPath, fileSet, files, info); err != nil {
+	if _, err := origTypesConfig.Check(pkgImportPath, fileSet, astFiles, info); err != nil {
 		return nil, fmt.Errorf("typecheck error: %v", err)
 	}
 
@@ -76,4 +82,4 @@ func getPkgImportPathFromFilePath(filePath string) (string, error) {
 		return "", err
 	}
 	return res.ImportPath, nil
-}
\ No newline at end of file
+}
@@ -1,181 +1,220 @@
 package ungarble
 
 import (
+	"bufio"
 	"go/importer"
 	"go/token"
 	"go/types"
-	"path/filepath"
-
-	//"math"
-	//"time"
-	"io/ioutil"
-	"strings"
-	//"strings"
-	//"strings"
-	"bufio"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
-	//"github.com/pkg/errors"
-	//"fmt"
-	"regexp"
 	"github.com/pkg/errors"
+
+	"mvdan.cc/garble/symbolmap"
 )
 
 var (
-	reFilename = regexp.MustCompile(`\s([a-zA-Z0-9_]+)\.go:\d`)
-	reMethodName = regexp.MustCompile(`[a-zA-Z0-9]\.([a-zA-Z0-9_]+)[\(|\s]`)
-	fileSet = token.NewFileSet()
-	origTypesConfig = types.Config{Importer: importer.ForCompiler(fileSet, "gc", origLookup)}
+	fileSet            = token.NewFileSet()
+	origTypesConfig    = types.Config{Importer: importer.ForCompiler(fileSet, "gc", origLookup)}
 	originalSourcePath = ""
 )
 
-func Ungarble(logFilePath, origSourcePath, salt, outputPath string) error {
+// Options configures Ungarble. The original names are either recovered from
+// the symbol map written by 'garble build' at MapPath, or by hashing the
+// identifiers found in the source at SourcePath with Salt.
+type Options struct {
+	LogPath    string
+	SourcePath string
+	Salt       string
+	MapPath    string
+	OutputPath string
+
+	// Map is used instead of MapPath when the map was already loaded, such
+	// as from an encrypted bundle.
+	Map *symbolmap.Map
+
+	// AllNames makes Ungarble replace every hashed name found anywhere in
+	// the log, such as types printed with %T or fields printed with %+v,
+	// and not just the ones in stack traces.
+	AllNames bool
+}
+
+func Ungarble(opts Options) error {
 
 	// set global
-	originalSourcePath = origSourcePath
+	originalSourcePath = opts.SourcePath
+
+	if opts.Map != nil {
+		useSymbolMap(opts.Map)
+	} else if opts.MapPath != "" {
+		err := loadSymbolMap(opts.MapPath)
+		if err != nil {
+			return errors.Wrap(err, "Failed to load symbol map")
+		}
+	} else {
+		// get needed info about all source files and put in a map
+		err := populateFileHashInfo(opts.Salt)
+		if err != nil {
+			return errors.Wrap(err, "Failed to populate file hash info")
+		}
+	}
 
-	// get needed info about all source files and put in a map
-	err := populateFileHashInfo(salt)
+	input, err := openLogInput(opts.LogPath)
 	if err != nil {
-		return errors.Wrap(err, "Failed to populate file hash info")
+		return err
 	}
+	defer input.Close()
 
-	// walk the log file looking for stacktraces, ungarbling them
-	ungarbledContent, err := walkLog(logFilePath, salt)
+	output, err := openLogOutput(opts.OutputPath)
 	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	// walk the log looking for stacktraces, ungarbling them as we go
+	if err := walkLog(input, output, opts.AllNames); err != nil {
 		return errors.Wrap(err, "Failed to walk log")
 	}
 
+	if err := output.Close(); err != nil {
+		return err
+	}
+
+	if opts.OutputPath != StdStream {
+		log.Println("Ungarbling successfully")
+	}
+
+	return nil
+}
+
+// Filter ungarbles the stack traces and file positions in r as it's copied
+// to w, with the names from a symbol map. 'garble test' uses it on the
+// output of the tests.
+func Filter(r io.Reader, w io.Writer, symbolMap *symbolmap.Map) error {
+	useSymbolMap(symbolMap)
+	return walkLog(r, w, false)
+}
+
+// StdStream may be used as the log or output path to read from stdin or
+// write to stdout, so that ungarble can be used as a filter.
+const StdStream = "-"
+
+func openLogInput(logPath string) (io.ReadCloser, error) {
+	if logPath == StdStream {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(logPath)
+}
+
+func openLogOutput(outputPath string) (io.WriteCloser, error) {
+	if outputPath == StdStream {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
 	// if outputPath not defined, use working directory
 	if outputPath == "" {
 		wd, err := os.Getwd()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		outputPath = filepath.Join(wd, "ungarbled_log.txt")
 	}
 
-	writeFinalResult(outputPath, ungarbledContent)
-
-	log.Println("Ungarbling successfully")
+	return os.Create(outputPath)
+}
 
-	return nil
+type nopWriteCloser struct {
+	io.Writer
 }
 
-// Reads the log file line by line, checking for stack traces 
+func (nopWriteCloser) Close() error { return nil }
+
+// Reads the log line by line, checking for stack traces
 // and replacing the hashed names with the original identifier names.
-// Returns a string, does not edit the original log file.
-func walkLog(filename, salt string) (string, error) {
-    file, err := os.OpenFile(filename, os.O_RDWR, 0644)
-    if err != nil {
-		return "", err
-    }
-	defer file.Close()
+//
+// Every frame in a goroutine dump is ungarbled, such as those printed by a
+// panic. Outside of those, a line which looks like a function is held back
+// until the next line tells us whether it's followed by a position, as in
+// the stack traces printed by github.com/pkg/errors. Every other line is
+// written and flushed straight away, so that followed logs aren't delayed.
+//
+// If allNames is set, any other hashed name in the log is replaced as well.
+func walkLog(r io.Reader, w io.Writer, allNames bool) error {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+
+	write := func(line string) error {
+		if allNames {
+			line = ungarbleAllNames(line)
+		}
+		_, err := writer.WriteString(line)
+		return err
+	}
 
-	reader := bufio.NewReader(file)
+	// whether we're in a goroutine dump
+	inDump := false
 
+	// the previous line, if it's being held back
 	var previousLineContent string
 
-	var newFileContent string
-
 	for {
-		line, _, err := reader.ReadLine()
-		if err != nil {
-			break
+		lineContent, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
 		}
-		if err != nil && err != io.EOF {
-			return "", err
+		if lineContent == "" {
+			break
 		}
 
-		lineContent := string(line) + "\n" // add \n because ReadLine strips the \n
-		//log.Println("Line content: ", lineContent)
-
-		fileNamePair := garblePair{}
-		
-		methodNamePair := garblePair{}
-
-
-		// This nesting is kind of ugly, but we only want to run one regex per line.
-		// The filecheck regex is more reliable in not picking up any false positives.
-		// So we backtrack and check the previous line for a method name if a filename was found.
-		// The filename will be on the current line
-		filenameFromLine := checkForFilename(lineContent)
-		if filenameFromLine != "" {
-			// line that was just read contained a hashed filename
-			fileNamePair.hashed = filenameFromLine
-			
-			// now we want to check if the previous line has a method name, it should
-			methodNameFromLine := checkForMethodName(previousLineContent)
-			if methodNameFromLine != "" {
-				// we have a hashed method name in the previous line
-				methodNamePair.hashed = methodNameFromLine
-			}
-		}
+		isFileLine := reFileLine.MatchString(lineContent)
 
-		// Get original identifier names
-		fileNamePair = getOriginalFileName(fileNamePair)
-		methodNamePair, e := getOriginalMethodName(methodNamePair, fileNamePair.hashed, salt)
-		if e != nil {
-			return "", e
+		if previousLineContent != "" && isFileLine {
+			previousLineContent = ungarbleFrameLine(previousLineContent)
 		}
 
-		toWrite := previousLineContent
-
-		previousLineContent = lineContent
-
-		if fileNamePair.hashed != "" {
-			previousLineContent = strings.Replace(lineContent, fileNamePair.hashed, fileNamePair.original, -1)
+		// the previous line is resolved now, either way
+		if err := write(previousLineContent); err != nil {
+			return err
+		}
+		previousLineContent = ""
+
+		switch {
+		case reGoroutine.MatchString(lineContent):
+			inDump = true
+		case strings.TrimSpace(lineContent) == "":
+			inDump = false
+		case isFileLine:
+			lineContent = ungarbleFileLine(lineContent)
+		case inDump:
+			lineContent = ungarbleFrameLine(lineContent)
+		default:
+			if _, ok := parseFrame(lineContent); ok && readErr == nil {
+				// might be a function; hold it until we see the next line
+				previousLineContent = lineContent
+				lineContent = ""
+			}
 		}
 
-		if methodNamePair.hashed != "" {
-			toWrite = strings.Replace(toWrite, methodNamePair.hashed, methodNamePair.original, -1)
+		if err := write(lineContent); err != nil {
+			return err
 		}
 
-		newFileContent += toWrite
+		if err := writer.Flush(); err != nil {
+			return err
+		}
 
-		if err != nil {
+		if readErr == io.EOF {
 			break
 		}
 	}
 
-	newFileContent += previousLineContent
-
-	return newFileContent, nil
-}
-
-// Check if string contains a filename, if so, return the filename without the extension
-// The regex used assumes we're only passing in a line we know is part of a go stacktrace
-func checkForFilename(line string) string {
-	return checkForSubmatch(reFilename, line)
-}
-
-// Check if string contains a function or method name, if so, return the name without parenthesis.
-// The regex used assumes we're only passing in a line we know is part of a go stacktrace
-func checkForMethodName(line string) string {
-	//log.Println(checkForSubmatch(reMethodName, line))
-	return checkForSubmatch(reMethodName, line)
-}
-
-func checkForSubmatch(re *regexp.Regexp, text string) string {
-	matchPair := re.FindSubmatch([]byte(text))
-	if matchPair == nil || len(matchPair) < 2 {
-		// no match or no submatch
-		return ""
-	}
-
-	// wholeMatch := matchPair[0]
-	subMatch := matchPair[1]
-	
-	return string(subMatch)
-}
-
-func writeFinalResult(fileName, content string) {
-	err := ioutil.WriteFile(fileName, []byte(content), 0644)
-	if err != nil {
-		log.Println(err)
+	if err := write(previousLineContent); err != nil {
+		return err
 	}
+	return writer.Flush()
 }
-